@@ -16,12 +16,19 @@ type Application struct {
 	Redis       Redis      `yaml:"redis" json:"redis"`
 	OAuth2      OAuth2     `yaml:"oauth2" json:"oauth2"`
 	WebAuthn    WebAuthn   `yaml:"webauthn" json:"webauthn"`
+	Otp         Otp        `yaml:"otp" json:"otp"`
+	Lockout     Lockout    `yaml:"lockout" json:"lockout"`
+	Pin         Pin        `yaml:"pin" json:"pin"`
+	QrLogin     QrLogin    `yaml:"qr-login" json:"qr_login"`
+	Admin       Admin      `yaml:"admin" json:"-"`
 }
 
 type Server struct {
 	ContextPath string `yaml:"context-path" json:"context_path"`
 	ApiVersion  string `yaml:"api-version" json:"api_version"`
 	Port        string `yaml:"port"`
+	// LocationHeader is set by the edge proxy with the client's geo location, e.g. CF-IPCountry
+	LocationHeader string `yaml:"location-header" json:"location_header"`
 }
 
 type Datasource struct {
@@ -32,10 +39,42 @@ type Datasource struct {
 	ConnectionMaxLifetime int    `yaml:"connection-max-lifetime" json:"connection_max_lifetime"`
 }
 type Security struct {
-	Secret                              string `yaml:"secret" json:"-"`
-	Issuer                              string `yaml:"issuer" json:"issuer"`
-	TokenValidityInSeconds              int    `yaml:"token-validity-in-seconds" json:"token_validity_in_seconds"`
-	TokenValidityInSecondsForRememberMe int    `yaml:"token-validity-in-seconds-for-remember-me" json:"token_validity_in_seconds_for_remember_me"`
+	Issuer                              string     `yaml:"issuer" json:"issuer"`
+	TokenValidityInSeconds              int        `yaml:"token-validity-in-seconds" json:"token_validity_in_seconds"`
+	TokenValidityInSecondsForRememberMe int        `yaml:"token-validity-in-seconds-for-remember-me" json:"token_validity_in_seconds_for_remember_me"`
+	Signing                             Signing    `yaml:"signing" json:"signing"`
+	Totp                                Totp       `yaml:"totp" json:"totp"`
+	Encryption                          Encryption `yaml:"encryption" json:"encryption"`
+	StepUp                              StepUp     `yaml:"step-up" json:"step_up"`
+}
+
+type StepUp struct {
+	MaxAgeInSeconds        int `yaml:"max-age-in-seconds" json:"max_age_in_seconds"`
+	TokenValidityInSeconds int `yaml:"token-validity-in-seconds" json:"token_validity_in_seconds"`
+}
+
+type Encryption struct {
+	CurrentKeyVersion          int      `yaml:"current-key-version" json:"current_key_version"`
+	MasterKeys                 []string `yaml:"master-keys" json:"-"`
+	MasterKeyFile              string   `yaml:"master-key-file" json:"-"`
+	ReencryptIntervalInSeconds int      `yaml:"reencrypt-interval-in-seconds" json:"reencrypt_interval_in_seconds"`
+}
+
+type Totp struct {
+	Issuer          string `yaml:"issuer" json:"issuer"`
+	PeriodInSeconds int    `yaml:"period-in-seconds" json:"period_in_seconds"`
+	Digits          int    `yaml:"digits" json:"digits"`
+	Algorithm       string `yaml:"algorithm" json:"algorithm"`
+	Skew            int    `yaml:"skew" json:"skew"`
+}
+
+type Signing struct {
+	Algorithm                 string   `yaml:"algorithm" json:"algorithm"`
+	KeyFiles                  []string `yaml:"key-files" json:"-"`
+	RotationIntervalInSeconds int      `yaml:"rotation-interval-in-seconds" json:"rotation_interval_in_seconds"`
+	// AllowEphemeralKeys lets a single local instance run with generated in-memory keys, never enable it in a
+	// deployment: every restart logs everyone out and replicas reject each other's tokens
+	AllowEphemeralKeys bool `yaml:"allow-ephemeral-keys" json:"allow_ephemeral_keys"`
 }
 
 type Redis struct {
@@ -50,7 +89,73 @@ type OAuth2 struct {
 }
 
 type WebAuthn struct {
-	RpDisplayName string `yaml:"rp-display-name" json:"rp_display_name"`
-	RpOrigin      string `yaml:"rp-origin" json:"rp_origin"`
-	RpID          string `yaml:"rp-id" json:"rp_id"`
+	RpDisplayName string   `yaml:"rp-display-name" json:"rp_display_name"`
+	RpID          string   `yaml:"rp-id" json:"rp_id"`
+	RpOrigins     []string `yaml:"rp-origins" json:"rp_origins"`
+	// RelatedOrigins may use RpID for passkeys, they are published at /.well-known/webauthn
+	RelatedOrigins []string `yaml:"related-origins" json:"related_origins"`
+	// Clients are "name|rp-id|origin,origin" entries, a frontend selects its RP with the X-WebAuthn-Client header
+	Clients     []string    `yaml:"clients" json:"clients"`
+	Attestation Attestation `yaml:"attestation" json:"attestation"`
+	Anomalies   Anomalies   `yaml:"anomalies" json:"anomalies"`
+	// TransactionReceiptValidityInSeconds is how long the signed approval of a transaction can be redeemed
+	TransactionReceiptValidityInSeconds int `yaml:"transaction-receipt-validity-in-seconds" json:"transaction_receipt_validity_in_seconds"`
+}
+
+type Anomalies struct {
+	SignCountRegression     string `yaml:"sign-count-regression" json:"sign_count_regression"`
+	BackupStateChange       string `yaml:"backup-state-change" json:"backup_state_change"`
+	MissingUserVerification string `yaml:"missing-user-verification" json:"missing_user_verification"`
+}
+
+type Attestation struct {
+	Conveyance      string   `yaml:"conveyance" json:"conveyance"`
+	MetadataFile    string   `yaml:"metadata-file" json:"metadata_file"`
+	RequireMetadata bool     `yaml:"require-metadata" json:"require_metadata"`
+	AllowedAaguids  []string `yaml:"allowed-aaguids" json:"allowed_aaguids"`
+	DeniedAaguids   []string `yaml:"denied-aaguids" json:"denied_aaguids"`
+}
+
+type Otp struct {
+	MaxAttempts     int        `yaml:"max-attempts" json:"max_attempts"`
+	ExpiryInSeconds int        `yaml:"expiry-in-seconds" json:"expiry_in_seconds"`
+	Email           OtpChannel `yaml:"email" json:"email"`
+	Phone           OtpChannel `yaml:"phone" json:"phone"`
+	Resend          OtpResend  `yaml:"resend" json:"resend"`
+}
+
+type OtpChannel struct {
+	Length   int    `yaml:"length" json:"length"`
+	Alphabet string `yaml:"alphabet" json:"alphabet"`
+}
+
+type OtpResend struct {
+	CooldownInSeconds        int `yaml:"cooldown-in-seconds" json:"cooldown_in_seconds"`
+	MaxCooldownInSeconds     int `yaml:"max-cooldown-in-seconds" json:"max_cooldown_in_seconds"`
+	DailyLimitPerDestination int `yaml:"daily-limit-per-destination" json:"daily_limit_per_destination"`
+	DailyLimitPerIp          int `yaml:"daily-limit-per-ip" json:"daily_limit_per_ip"`
+}
+
+type Lockout struct {
+	PasswordMaxFailures    int `yaml:"password-max-failures" json:"password_max_failures"`
+	PinMaxFailures         int `yaml:"pin-max-failures" json:"pin_max_failures"`
+	TotpMaxFailures        int `yaml:"totp-max-failures" json:"totp_max_failures"`
+	FailureWindowInSeconds int `yaml:"failure-window-in-seconds" json:"failure_window_in_seconds"`
+	BaseLockInSeconds      int `yaml:"base-lock-in-seconds" json:"base_lock_in_seconds"`
+	MaxLockInSeconds       int `yaml:"max-lock-in-seconds" json:"max_lock_in_seconds"`
+}
+
+type Pin struct {
+	Length int `yaml:"length" json:"length"`
+}
+
+// QrLogin configures the link inside the login QR code, BaseURL may be an https app link or a custom
+// scheme deep link (e.g. mocaapp://qr-login), the session id is appended as the sessionId query parameter
+type QrLogin struct {
+	BaseURL string `yaml:"base-url" json:"base_url"`
+	Size    int    `yaml:"size" json:"size"`
+}
+
+type Admin struct {
+	ApiKey string `yaml:"api-key"`
 }
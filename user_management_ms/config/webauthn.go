@@ -1,16 +1,174 @@
 package config
 
-import "github.com/go-webauthn/webauthn/webauthn"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 
-func InitWebAuthn() *webauthn.WebAuthn {
-	wa, err := webauthn.New(&webauthn.Config{
-		RPDisplayName: Conf.Application.WebAuthn.RpDisplayName,
-		RPID:          Conf.Application.WebAuthn.RpID,
-		RPOrigins:     []string{Conf.Application.WebAuthn.RpOrigin},
-	})
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/metadata/providers/memory"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
 
+var ErrUnknownWebAuthnClient = errors.New("unknown webauthn client")
+
+// RelyingParties holds one WebAuthn configuration per RP ID. Frontends pick theirs by client name when a
+// ceremony starts, the finish step follows the RP ID recorded in the session.
+type RelyingParties struct {
+	defaultRP      *webauthn.WebAuthn
+	byID           map[string]*webauthn.WebAuthn
+	clients        map[string]string
+	relatedOrigins []string
+}
+
+// ForClient returns the relying party of a frontend, an empty client name selects the default one
+func (rp *RelyingParties) ForClient(client string) (*webauthn.WebAuthn, error) {
+	if client == "" {
+		return rp.defaultRP, nil
+	}
+	id, ok := rp.clients[client]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownWebAuthnClient, client)
+	}
+	return rp.byID[id], nil
+}
+
+// ForSession returns the relying party that started the ceremony
+func (rp *RelyingParties) ForSession(session *webauthn.SessionData) (*webauthn.WebAuthn, error) {
+	if session.RelyingPartyID == "" {
+		return rp.defaultRP, nil
+	}
+	wa, ok := rp.byID[session.RelyingPartyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown relying party %q", session.RelyingPartyID)
+	}
+	return wa, nil
+}
+
+// RelatedOrigins are the origins allowed to use the default RP ID, served at /.well-known/webauthn
+func (rp *RelyingParties) RelatedOrigins() []string {
+	return rp.relatedOrigins
+}
+
+func InitWebAuthn() *RelyingParties {
+	conf := Conf.Application.WebAuthn
+	mds, err := loadMetadata(conf.Attestation)
 	if err != nil {
 		panic(err)
 	}
-	return wa
+
+	// NOTE: Origins are grouped by RP ID, every client sharing an RP ID accepts the origins of the others
+	origins := map[string][]string{conf.RpID: append(append([]string{}, conf.RpOrigins...), conf.RelatedOrigins...)}
+	clients := map[string]string{}
+	for _, entry := range conf.Clients {
+		name, rpID, clientOrigins, err := parseWebAuthnClient(entry, conf.RpID)
+		if err != nil {
+			panic(err)
+		}
+		clients[name] = rpID
+		origins[rpID] = append(origins[rpID], clientOrigins...)
+	}
+
+	byID := make(map[string]*webauthn.WebAuthn, len(origins))
+	for rpID, rpOrigins := range origins {
+		wa, err := webauthn.New(&webauthn.Config{
+			RPDisplayName:         conf.RpDisplayName,
+			RPID:                  rpID,
+			RPOrigins:             dedupe(rpOrigins),
+			AttestationPreference: protocol.ConveyancePreference(conf.Attestation.Conveyance),
+			MDS:                   mds,
+		})
+		if err != nil {
+			panic(fmt.Errorf("webauthn rp %s: %w", rpID, err))
+		}
+		byID[rpID] = wa
+	}
+	return &RelyingParties{
+		defaultRP:      byID[conf.RpID],
+		byID:           byID,
+		clients:        clients,
+		relatedOrigins: conf.RelatedOrigins,
+	}
+}
+
+// WebOrigins lists the browser origins of every configured relying party and client, the CORS allow list.
+// App origins (android:apk-key-hash:...) are left out, they are not sent by browsers.
+func WebOrigins() []string {
+	conf := Conf.Application.WebAuthn
+	origins := append(append([]string{}, conf.RpOrigins...), conf.RelatedOrigins...)
+	for _, entry := range conf.Clients {
+		if _, _, clientOrigins, err := parseWebAuthnClient(entry, conf.RpID); err == nil {
+			origins = append(origins, clientOrigins...)
+		}
+	}
+	web := make([]string, 0, len(origins))
+	for _, origin := range dedupe(origins) {
+		if strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://") {
+			web = append(web, origin)
+		}
+	}
+	return web
+}
+
+// parseWebAuthnClient reads a "name|rp-id|origin,origin" entry, an empty RP ID means the default one
+func parseWebAuthnClient(entry, defaultRPID string) (string, string, []string, error) {
+	parts := strings.Split(entry, "|")
+	if len(parts) != 3 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", nil, fmt.Errorf("invalid webauthn client %q, expected name|rp-id|origins", entry)
+	}
+	rpID := strings.TrimSpace(parts[1])
+	if rpID == "" {
+		rpID = defaultRPID
+	}
+	var origins []string
+	for _, origin := range strings.Split(parts[2], ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return strings.TrimSpace(parts[0]), rpID, origins, nil
+}
+
+func dedupe(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// loadMetadata parses the locally stored MDS3 blob, its signature is checked against the FIDO root certificate
+func loadMetadata(attestation Attestation) (metadata.Provider, error) {
+	if attestation.MetadataFile == "" {
+		return nil, nil
+	}
+	blob, err := os.ReadFile(attestation.MetadataFile)
+	if err != nil {
+		return nil, fmt.Errorf("read metadata file: %w", err)
+	}
+	decoder, err := metadata.NewDecoder(metadata.WithIgnoreEntryParsingErrors())
+	if err != nil {
+		return nil, err
+	}
+	payload, err := decoder.DecodeBytes(blob)
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata blob: %w", err)
+	}
+	parsed, err := decoder.Parse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("parse metadata blob: %w", err)
+	}
+	return memory.New(
+		memory.WithMetadata(parsed.ToMap()),
+		memory.WithValidateEntry(attestation.RequireMetadata),
+		memory.WithValidateEntryPermitZeroAAGUID(!attestation.RequireMetadata),
+		memory.WithValidateTrustAnchor(true),
+		memory.WithValidateStatus(true),
+	)
 }
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"user_management_ms/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type IAdminController interface {
+	UnlockUser(c *fiber.Ctx) error
+	ReencryptSecrets(c *fiber.Ctx) error
+}
+
+type AdminController struct {
+	lockoutService services.ILockoutService
+	reencryptor    *services.SecretReencryptor
+}
+
+func NewAdminController(lockoutService services.ILockoutService, reencryptor *services.SecretReencryptor) IAdminController {
+	return &AdminController{lockoutService: lockoutService, reencryptor: reencryptor}
+}
+
+// UnlockUser lifts the lockout of one factor (?factor=password|pin|totp) or of all factors of the user
+func (ac *AdminController) UnlockUser(c *fiber.Ctx) error {
+	userId, err := strconv.ParseUint(c.Params("userId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user id",
+		})
+	}
+	if err := ac.lockoutService.Unlock(uint(userId), c.Query("factor")); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "User unlocked",
+	})
+}
+
+// ReencryptSecrets seals every encrypted column with the current master key right away, e.g. after a rotation
+func (ac *AdminController) ReencryptSecrets(c *fiber.Ctx) error {
+	count, err := ac.reencryptor.Run()
+	if errors.Is(err, services.ErrReencryptionRunning) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":       err.Error(),
+			"reencrypted": count,
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"reencrypted": count,
+	})
+}
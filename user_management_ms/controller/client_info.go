@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"user_management_ms/config"
+	"user_management_ms/dtos/request"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// clientInfo collects the device details recorded on the session created by a login
+func clientInfo(c *fiber.Ctx) *request.ClientInfo {
+	return &request.ClientInfo{
+		DeviceName: c.Get("X-Device-Name"),
+		UserAgent:  c.Get(fiber.HeaderUserAgent),
+		IP:         c.IP(),
+		Location:   clientLocation(c),
+	}
+}
+
+// clientLocation reads the geo location added by the edge proxy, the proxy must overwrite it on every request
+func clientLocation(c *fiber.Ctx) string {
+	if header := config.Conf.Application.Server.LocationHeader; header != "" {
+		return c.Get(header)
+	}
+	return ""
+}
+
+// webAuthnClient names the frontend starting a passkey ceremony, it selects the relying party configuration
+func webAuthnClient(c *fiber.Ctx) string {
+	return c.Get("X-WebAuthn-Client")
+}
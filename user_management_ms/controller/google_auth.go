@@ -1,12 +1,13 @@
 package controller
 
 import (
+	"crypto/subtle"
+	"errors"
 	"log"
 	"user_management_ms/dtos/request"
 	"user_management_ms/services"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/hashicorp/go-uuid"
 )
 
 type IGoogleAuthController interface {
@@ -26,34 +27,57 @@ func NewGoogleAuthController(googleService services.IGoogleAuthService) IGoogleA
 	return &GoogleAuthController{googleService: googleService}
 }
 
+// googleStateCookie binds the login attempt to the browser that started it, a callback carrying a state
+// from someone else's attempt (login CSRF) is rejected
+const googleStateCookie = "google_oauth_state"
+
 func (ac *GoogleAuthController) GoogleLogin(c *fiber.Ctx) error {
-	state, _ := uuid.GenerateUUID()
-	url := ac.googleService.LoginGoogle(state)
+	url, state, err := ac.googleService.LoginGoogle()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     googleStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   600,
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
 
 	return c.Redirect(url, fiber.StatusTemporaryRedirect)
 }
 func (ac *GoogleAuthController) GoogleCallback(c *fiber.Ctx) error {
+	if reason := c.Query("error"); reason != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": reason,
+		})
+	}
 	code := c.Query("code")
 	if code == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "code is required",
 		})
 	}
-	// 1. Exchange code for token
-	token, err := ac.googleService.ExchangeGoogleToken(code)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
+	// 1. The state must be the one this browser was given when the login started
+	state := c.Query("state")
+	cookieState := c.Cookies(googleStateCookie)
+	c.Cookie(&fiber.Cookie{Name: googleStateCookie, Path: "/", MaxAge: -1, HTTPOnly: true, Secure: true, SameSite: fiber.CookieSameSiteLaxMode})
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookieState)) != 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": services.ErrOAuthState.Error(),
 		})
 	}
-	idToken, ok := token.Extra("id_token").(string)
-	if !ok {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "id_token is required",
+	// 2. Exchange code with the PKCE verifier and verify the Google ID token and its nonce
+	userInfo, err := ac.googleService.CompleteGoogleLogin(state, code)
+	if errors.Is(err, services.ErrOAuthState) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
 		})
 	}
-	// 2. Verify Google ID token
-	userInfo, err := ac.googleService.VerifyGoogleIDToken(idToken)
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": err.Error(),
@@ -78,7 +102,12 @@ func (ac *GoogleAuthController) GoogleCallback(c *fiber.Ctx) error {
 		})
 	}
 	if isNew == false && !user.PhoneVerified {
-		if _, err := ac.googleService.SendPhoneVerificationOtp(&request.OTPRequestPhone{Phone: user.Phone}); err != nil {
+		otpResponse, err := ac.googleService.SendPhoneVerificationOtp(&request.OTPRequestPhone{Phone: user.Phone}, clientInfo(c))
+		var throttled *services.OTPThrottledError
+		if errors.As(err, &throttled) {
+			return otpThrottledResponse(c, throttled)
+		}
+		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": err.Error(),
 			})
@@ -90,10 +119,17 @@ func (ac *GoogleAuthController) GoogleCallback(c *fiber.Ctx) error {
 			"phone":              user.Phone,
 			"email":              user.Email,
 			"google_id":          user.GoogleID,
+			"challenge_id":       otpResponse.ChallengeId,
+			"resend_after":       otpResponse.ResendAfter,
 		})
 	}
 	if isNew == false && user.GoogleID != "" {
-		if _, err := ac.googleService.SendEmailLoginOtp(&request.OTPRequestEmail{Email: user.Email}); err != nil {
+		otpResponse, err := ac.googleService.SendEmailLoginOtp(&request.OTPRequestEmail{Email: user.Email}, clientInfo(c))
+		var throttled *services.OTPThrottledError
+		if errors.As(err, &throttled) {
+			return otpThrottledResponse(c, throttled)
+		}
+		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": err.Error(),
 			})
@@ -105,6 +141,8 @@ func (ac *GoogleAuthController) GoogleCallback(c *fiber.Ctx) error {
 			"phone":              user.Phone,
 			"email":              user.Email,
 			"google_id":          user.GoogleID,
+			"challenge_id":       otpResponse.ChallengeId,
+			"resend_after":       otpResponse.ResendAfter,
 		})
 	}
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{})
@@ -120,8 +158,12 @@ func (ac *GoogleAuthController) GoogleRequestPhoneOTP(c *fiber.Ctx) error {
 		})
 	}
 	log.Println(req.Phone)
-	res, err := ac.googleService.StartGoogleRegistration(&request.StartGoogleRegistration{Email: email, Phone: req.Phone})
+	res, err := ac.googleService.StartGoogleRegistration(&request.StartGoogleRegistration{Email: email, Phone: req.Phone}, clientInfo(c))
 	if err != nil {
+		var throttled *services.OTPThrottledError
+		if errors.As(err, &throttled) {
+			return otpThrottledResponse(c, throttled)
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
 		})
@@ -138,7 +180,7 @@ func (ac *GoogleAuthController) GoogleVerifyRequestOTP(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	res, err := ac.googleService.VerifyPhoneOTP(&request.VerifyNumberOTPRequest{Email: email, Phone: phone, PhoneOTP: req.PhoneOTP})
+	res, err := ac.googleService.VerifyPhoneOTP(&request.VerifyNumberOTPRequest{ChallengeId: req.ChallengeId, Email: email, Phone: phone, PhoneOTP: req.PhoneOTP})
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -155,7 +197,7 @@ func (ac *GoogleAuthController) GoogleVerifyLoginRequestOtp(c *fiber.Ctx) error
 			"error": err.Error(),
 		})
 	}
-	tokens, err := ac.googleService.VerifyGoogleLoginOtp(&request.VerifyEmailOTPRequest{Email: email, EmailOTP: req.EmailOTP})
+	tokens, err := ac.googleService.VerifyGoogleLoginOtp(&request.VerifyEmailOTPRequest{ChallengeId: req.ChallengeId, Email: email, EmailOTP: req.EmailOTP}, clientInfo(c))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -172,7 +214,7 @@ func (ac *GoogleAuthController) CompleteGoogleRegistration(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	res, err := ac.googleService.CompleteGoogleRegistration(&request.CompleteGoogleRegistration{Email: email, BirthDate: compete.BirthDate, Password: compete.Password})
+	res, err := ac.googleService.CompleteGoogleRegistration(&request.CompleteGoogleRegistration{Email: email, BirthDate: compete.BirthDate, Password: compete.Password}, clientInfo(c))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"user_management_ms/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type IJWKSController interface {
+	JWKS(c *fiber.Ctx) error
+}
+
+type JWKSController struct {
+	jwtService services.IJWTService
+}
+
+func NewJWKSController(jwtService services.IJWTService) IJWKSController {
+	return &JWKSController{jwtService: jwtService}
+}
+
+// JWKS publishes the token verification keys for downstream services
+func (jc *JWKSController) JWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(jc.jwtService.JWKS())
+}
@@ -1,12 +1,15 @@
 package controller
 
 import (
+	"errors"
 	"net/http"
+	"user_management_ms/config"
 	"user_management_ms/dtos/request"
 
 	"user_management_ms/services"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/valyala/fasthttp/fasthttpadaptor"
 )
 
@@ -15,6 +18,14 @@ type IPasskeyController interface {
 	RegisterFinish(c *fiber.Ctx) error
 	LoginStart(c *fiber.Ctx) error
 	LoginFinish(c *fiber.Ctx) error
+	StepUpStart(c *fiber.Ctx) error
+	StepUpFinish(c *fiber.Ctx) error
+	TransactionStart(c *fiber.Ctx) error
+	TransactionFinish(c *fiber.Ctx) error
+	ListPasskeys(c *fiber.Ctx) error
+	RenamePasskey(c *fiber.Ctx) error
+	DeletePasskey(c *fiber.Ctx) error
+	RelatedOrigins(c *fiber.Ctx) error
 }
 
 type PasskeyController struct {
@@ -27,7 +38,10 @@ func NewPasskeyController(service services.IPasskeyService) IPasskeyController {
 
 func (pc *PasskeyController) RegisterStart(c *fiber.Ctx) error {
 	userId := c.Locals("userId")
-	options, err := pc.service.RegisterStart(&request.StartPasskeyRegistrationRequest{UserId: uint(userId.(float64))})
+	options, err := pc.service.RegisterStart(&request.StartPasskeyRegistrationRequest{UserId: uint(userId.(float64)), Client: webAuthnClient(c)})
+	if errors.Is(err, config.ErrUnknownWebAuthnClient) {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -45,13 +59,32 @@ func (pc *PasskeyController) RegisterFinish(c *fiber.Ctx) error {
 
 	// 4. Call service to finish registration
 	if err := pc.service.RegisterFinish(uint(userId.(float64)), req); err != nil {
+		if errors.Is(err, services.ErrAuthenticatorNotAllowed) || errors.Is(err, services.ErrAttestationRequired) {
+			return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+		}
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	return c.Status(201).JSON(fiber.Map{})
 }
 
 func (pc *PasskeyController) LoginStart(c *fiber.Ctx) error {
-	options, sessionId, err := pc.service.LoginStart()
+	var req request.PasskeyLoginStartRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	req.Client = webAuthnClient(c)
+	options, sessionId, err := pc.service.LoginStart(&req)
+	if errors.Is(err, config.ErrUnknownWebAuthnClient) {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, services.ErrNoPasskeys) {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -69,7 +102,11 @@ func (pc *PasskeyController) LoginFinish(c *fiber.Ctx) error {
 	if err := fasthttpadaptor.ConvertRequest(c.Context(), req, true); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "failed to convert request"})
 	}
-	user, err := pc.service.LoginFinish(sessionId, req)
+	user, err := pc.service.LoginFinish(sessionId, req, clientInfo(c))
+	var throttled *services.OTPThrottledError
+	if errors.As(err, &throttled) {
+		return otpThrottledResponse(c, throttled)
+	}
 	if err != nil {
 		return c.Status(401).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -77,3 +114,139 @@ func (pc *PasskeyController) LoginFinish(c *fiber.Ctx) error {
 		"user": user,
 	})
 }
+
+func (pc *PasskeyController) StepUpStart(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	options, sessionId, err := pc.service.StepUpStart(uint(userId.(float64)), webAuthnClient(c))
+	if errors.Is(err, config.ErrUnknownWebAuthnClient) {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"sessionId": sessionId,
+		"options":   options,
+	})
+}
+
+func (pc *PasskeyController) StepUpFinish(c *fiber.Ctx) error {
+	sessionId := c.Params("sessionId")
+	req := new(http.Request)
+	if err := fasthttpadaptor.ConvertRequest(c.Context(), req, true); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to convert request"})
+	}
+	token, err := pc.service.StepUpFinish(c.Locals("claims").(jwt.MapClaims), sessionId, req)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(200).JSON(token)
+}
+
+// TransactionStart asks for a passkey approval of a sensitive operation, e.g. a withdrawal
+func (pc *PasskeyController) TransactionStart(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	var req request.PasskeyTransactionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	req.Client = webAuthnClient(c)
+	options, transactionId, err := pc.service.TransactionStart(uint(userId.(float64)), &req)
+	if errors.Is(err, config.ErrUnknownWebAuthnClient) {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"transactionId": transactionId,
+		"options":       options,
+	})
+}
+
+func (pc *PasskeyController) TransactionFinish(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	transactionId := c.Params("transactionId")
+	req := new(http.Request)
+	if err := fasthttpadaptor.ConvertRequest(c.Context(), req, true); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to convert request"})
+	}
+	receipt, err := pc.service.TransactionFinish(uint(userId.(float64)), transactionId, req)
+	if errors.Is(err, services.ErrTransactionNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(200).JSON(receipt)
+}
+
+func (pc *PasskeyController) ListPasskeys(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	passkeys, err := pc.service.ListPasskeys(uint(userId.(float64)))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"passkeys": passkeys,
+	})
+}
+
+func (pc *PasskeyController) RenamePasskey(c *fiber.Ctx) error {
+	passkeyId, err := c.ParamsInt("passkeyId")
+	if err != nil || passkeyId <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid passkey id"})
+	}
+	var req request.RenamePasskeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userId := c.Locals("userId")
+	if err := pc.service.RenamePasskey(uint(userId.(float64)), uint(passkeyId), req.Nickname); err != nil {
+		return passkeyError(c, err)
+	}
+	return c.JSON(fiber.Map{"message": "Passkey renamed"})
+}
+
+func (pc *PasskeyController) DeletePasskey(c *fiber.Ctx) error {
+	passkeyId, err := c.ParamsInt("passkeyId")
+	if err != nil || passkeyId <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid passkey id"})
+	}
+
+	userId := c.Locals("userId")
+	if err := pc.service.DeletePasskey(uint(userId.(float64)), uint(passkeyId)); err != nil {
+		return passkeyError(c, err)
+	}
+	return c.JSON(fiber.Map{"message": "Passkey deleted"})
+}
+
+func passkeyError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrPasskeyNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrLastLoginMethod):
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+}
+
+// RelatedOrigins publishes the WebAuthn related origin requests document, browsers fetch it from the RP ID
+// host before letting another origin use its passkeys
+func (pc *PasskeyController) RelatedOrigins(c *fiber.Ctx) error {
+	origins := pc.service.RelatedOrigins()
+	if len(origins) == 0 {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"origins": origins})
+}
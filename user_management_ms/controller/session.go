@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"user_management_ms/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type ISessionController interface {
+	ListSessions(c *fiber.Ctx) error
+	RevokeSession(c *fiber.Ctx) error
+}
+
+type SessionController struct {
+	tokenService services.ITokenService
+}
+
+func NewSessionController(tokenService services.ITokenService) ISessionController {
+	return &SessionController{tokenService: tokenService}
+}
+
+func (sc *SessionController) ListSessions(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	claims := c.Locals("claims").(jwt.MapClaims)
+	currentSessionId, _ := claims["fid"].(string)
+
+	sessions, err := sc.tokenService.ListSessions(uint(userId.(float64)), currentSessionId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"sessions": sessions,
+	})
+}
+
+func (sc *SessionController) RevokeSession(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	sessionId := c.Params("sessionId")
+
+	if err := sc.tokenService.RevokeUserSession(uint(userId.(float64)), sessionId); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Session revoked",
+	})
+}
@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"strconv"
+	"user_management_ms/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// otpThrottledResponse answers a throttled OTP send with 429 and the seconds until the client may retry
+func otpThrottledResponse(c *fiber.Ctx, throttled *services.OTPThrottledError) error {
+	seconds := throttled.RetryAfterSeconds()
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":        throttled.Error(),
+		"resend_after": seconds,
+	})
+}
+
+// accountLockedResponse answers an attempt on a locked factor with 423 and the seconds until the lock ends
+func accountLockedResponse(c *fiber.Ctx, locked *services.AccountLockedError) error {
+	seconds := locked.RetryAfterSeconds()
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+		"error":       locked.Error(),
+		"retry_after": seconds,
+	})
+}
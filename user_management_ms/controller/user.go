@@ -1,13 +1,20 @@
 package controller
 
 import (
+	"bufio"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"user_management_ms/dtos/request"
+	"user_management_ms/dtos/response"
 	"user_management_ms/services"
+	"user_management_ms/util"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 type IAuthController interface {
@@ -17,14 +24,31 @@ type IAuthController interface {
 	CompleteRegistration(c *fiber.Ctx) error
 	ResendOTP(c *fiber.Ctx) error
 	VerifyLoginOTP(c *fiber.Ctx) error
+	VerifyLoginMFA(c *fiber.Ctx) error
+	VerifyLoginMFAOTP(c *fiber.Ctx) error
 	RefreshToken(c *fiber.Ctx) error
+	Logout(c *fiber.Ctx) error
+	LogoutAll(c *fiber.Ctx) error
 	Setup2FA(c *fiber.Ctx) error
 	Verify2FA(c *fiber.Ctx) error
+	VerifyLoginRecovery(c *fiber.Ctx) error
+	RegenerateRecoveryCodes(c *fiber.Ctx) error
+	Disable2FA(c *fiber.Ctx) error
+	Reenroll2FA(c *fiber.Ctx) error
+	ConfirmReenroll2FA(c *fiber.Ctx) error
 	SetPIN(c *fiber.Ctx) error
 	VerifyPIN(c *fiber.Ctx) error
+	ChangePIN(c *fiber.Ctx) error
+	RequestPINReset(c *fiber.Ctx) error
+	ResetPIN(c *fiber.Ctx) error
+	StepUp(c *fiber.Ctx) error
 	QrLoginRequest(c *fiber.Ctx) error
+	ScanLoginRequest(c *fiber.Ctx) error
 	ApproveLoginRequest(c *fiber.Ctx) error
+	RejectLoginRequest(c *fiber.Ctx) error
+	CancelLoginRequest(c *fiber.Ctx) error
 	CheckLoginRequest(c *fiber.Ctx) error
+	LoginRequestEvents(c *fiber.Ctx) error
 }
 
 var validate = validator.New()
@@ -35,7 +59,12 @@ type AuthController struct {
 
 func (ac *AuthController) CheckLoginRequest(c *fiber.Ctx) error {
 	sessionId := c.Params("sessionId")
-	response, err := ac.userService.CheckLoginQr(sessionId)
+	response, err := ac.userService.CheckLoginQr(sessionId, qrLoginSecret(c))
+	if errors.Is(err, services.ErrQrLoginSecret) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -44,7 +73,44 @@ func (ac *AuthController) CheckLoginRequest(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(response)
 }
 
-func (ac *AuthController) ApproveLoginRequest(c *fiber.Ctx) error {
+// LoginRequestEvents streams the QR login state to the desktop as Server-Sent Events, the stream ends with
+// APPROVED (carrying the tokens), REJECTED, CANCELLED or EXPIRED
+func (ac *AuthController) LoginRequestEvents(c *fiber.Ctx) error {
+	sessionId := c.Params("sessionId")
+	secret := qrLoginSecret(c)
+	if err := ac.userService.AuthorizeLoginQr(sessionId, secret); err != nil {
+		status := fiber.StatusUnauthorized
+		if errors.Is(err, services.ErrQrLoginNotFound) {
+			status = fiber.StatusNotFound
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		err := ac.userService.WatchLoginQr(sessionId, secret, func(event *response.QrLoginResponse) error {
+			if event == nil {
+				fmt.Fprint(w, ": keep-alive\n\n")
+			} else {
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			}
+			return w.Flush()
+		})
+		if err != nil && !errors.Is(err, services.ErrQrLoginSecret) {
+			log.Printf("qr login stream %s closed: %v", sessionId, err)
+		}
+	})
+	return nil
+}
+
+// ScanLoginRequest is called by the phone right after scanning, it shows the requesting device before approval
+func (ac *AuthController) ScanLoginRequest(c *fiber.Ctx) error {
 	userId := c.Locals("userId")
 
 	var req struct {
@@ -57,29 +123,113 @@ func (ac *AuthController) ApproveLoginRequest(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := ac.userService.ApproveLoginQr(uint(userId.(float64)), req.SessionId); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
+	claims := c.Locals("claims").(jwt.MapClaims)
+	scannerSessionId, _ := claims["fid"].(string)
+	scan, err := ac.userService.ScanLoginQr(uint(userId.(float64)), scannerSessionId, req.SessionId)
+	if err != nil {
+		return qrLoginError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(scan)
+}
+
+func (ac *AuthController) ApproveLoginRequest(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+
+	var req struct {
+		SessionId string `json:"sessionId"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
 		})
 	}
 
-	log.Println(userId)
+	claims := c.Locals("claims").(jwt.MapClaims)
+	approverSessionId, _ := claims["fid"].(string)
+	if err := ac.userService.ApproveLoginQr(uint(userId.(float64)), approverSessionId, req.SessionId); err != nil {
+		return qrLoginError(c, err)
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "QR login approved",
 	})
 }
 
+// RejectLoginRequest lets the phone deny a scanned QR login
+func (ac *AuthController) RejectLoginRequest(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+
+	var req struct {
+		SessionId string `json:"sessionId"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	claims := c.Locals("claims").(jwt.MapClaims)
+	scannerSessionId, _ := claims["fid"].(string)
+	if err := ac.userService.RejectLoginQr(uint(userId.(float64)), scannerSessionId, req.SessionId); err != nil {
+		return qrLoginError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "QR login rejected",
+	})
+}
+
+// CancelLoginRequest lets the desktop withdraw its QR login, it proves ownership with the polling secret
+func (ac *AuthController) CancelLoginRequest(c *fiber.Ctx) error {
+	if err := ac.userService.CancelLoginQr(c.Params("sessionId"), qrLoginSecret(c)); err != nil {
+		return qrLoginError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "QR login cancelled",
+	})
+}
+
 func (ac *AuthController) QrLoginRequest(c *fiber.Ctx) error {
-	png, sessionId, err := ac.userService.RequestLoginQr()
+	var req request.QrLoginRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	challenge, err := ac.userService.RequestLoginQr(&req, clientInfo(c))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"base64png": base64.StdEncoding.EncodeToString(png),
-		"sessionId": sessionId,
-	})
+	return c.Status(fiber.StatusOK).JSON(challenge)
+}
+
+// qrLoginSecret reads the desktop's polling secret, EventSource cannot send headers so the query is accepted too
+func qrLoginSecret(c *fiber.Ctx) string {
+	if secret := c.Get("X-QR-Secret"); secret != "" {
+		return secret
+	}
+	return c.Query("secret")
+}
+
+func qrLoginError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrQrLoginSecret):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrQrLoginNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrQrLoginState):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 }
 
 func NewAuthController(service services.IUserService) IAuthController {
@@ -100,8 +250,12 @@ func (ac *AuthController) RegisterRequestOTP(c *fiber.Ctx) error {
 		})
 	}
 
-	response, err := ac.userService.RegisterRequestOTP(&req)
+	response, err := ac.userService.RegisterRequestOTP(&req, clientInfo(c))
 	if err != nil {
+		var throttled *services.OTPThrottledError
+		if errors.As(err, &throttled) {
+			return otpThrottledResponse(c, throttled)
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
 		})
@@ -123,7 +277,7 @@ func (ac *AuthController) VerifyRegisterOTP(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	response, err := ac.userService.VerifyRegisterOTP(&request.VerifyOTPRequest{Email: email, Phone: phone, EmailOTP: req.EmailOTP, PhoneOTP: req.PhoneOTP})
+	response, err := ac.userService.VerifyRegisterOTP(&request.VerifyOTPRequest{ChallengeId: req.ChallengeId, Email: email, Phone: phone, EmailOTP: req.EmailOTP, PhoneOTP: req.PhoneOTP})
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -145,7 +299,7 @@ func (ac *AuthController) CompleteRegistration(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	response, err := ac.userService.CompleteRegistration(&request.CompleteRegisterRequest{Email: email, Password: req.Password, BirthDate: req.BirthDate})
+	response, err := ac.userService.CompleteRegistration(&request.CompleteRegisterRequest{Email: email, Password: req.Password, BirthDate: req.BirthDate}, clientInfo(c))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -162,8 +316,12 @@ func (ac *AuthController) ResendOTP(c *fiber.Ctx) error {
 	if err := validate.Struct(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{})
 	}
-	response, err := ac.userService.SendOTP(&req)
+	response, err := ac.userService.SendOTP(&req, clientInfo(c))
 	if err != nil {
+		var throttled *services.OTPThrottledError
+		if errors.As(err, &throttled) {
+			return otpThrottledResponse(c, throttled)
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{})
 	}
 	return c.Status(fiber.StatusOK).JSON(response)
@@ -181,8 +339,16 @@ func (ac *AuthController) LoginLocal(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	response, err := ac.userService.LoginLocal(&req)
+	response, err := ac.userService.LoginLocal(&req, clientInfo(c))
 	if err != nil {
+		var locked *services.AccountLockedError
+		if errors.As(err, &locked) {
+			return accountLockedResponse(c, locked)
+		}
+		var throttled *services.OTPThrottledError
+		if errors.As(err, &throttled) {
+			return otpThrottledResponse(c, throttled)
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
 		})
@@ -204,7 +370,7 @@ func (ac *AuthController) VerifyLoginOTP(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	response, err := ac.userService.VerifyLoginOTP(&request.VerifyOTPRequest{Email: email, Phone: phone, EmailOTP: req.EmailOTP, PhoneOTP: req.PhoneOTP})
+	response, err := ac.userService.VerifyLoginOTP(&request.VerifyOTPRequest{ChallengeId: req.ChallengeId, Email: email, Phone: phone, EmailOTP: req.EmailOTP, PhoneOTP: req.PhoneOTP}, clientInfo(c))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -220,7 +386,7 @@ func (ac *AuthController) RefreshToken(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	response, err := ac.userService.RefreshToken(req)
+	response, err := ac.userService.RefreshToken(req, clientInfo(c))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -229,11 +395,81 @@ func (ac *AuthController) RefreshToken(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(response)
 }
 
-func (ac *AuthController) Setup2FA(c *fiber.Ctx) error {
-	email := c.Query("email")
-	phone := c.Query("phone")
+func (ac *AuthController) Logout(c *fiber.Ctx) error {
+	claims := c.Locals("claims").(jwt.MapClaims)
+	if err := ac.userService.Logout(claims); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Logged out",
+	})
+}
+
+func (ac *AuthController) LogoutAll(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	if err := ac.userService.LogoutAll(uint(userId.(float64))); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Logged out from all sessions",
+	})
+}
+
+// VerifyLoginMFA exchanges the MFA ticket of a login and a TOTP code for the session tokens
+func (ac *AuthController) VerifyLoginMFA(c *fiber.Ctx) error {
+	var req request.MFAVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	response, err := ac.userService.VerifyLoginMFA(&req, clientInfo(c))
+	if err != nil {
+		var locked *services.AccountLockedError
+		if errors.As(err, &locked) {
+			return accountLockedResponse(c, locked)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// VerifyLoginMFAOTP exchanges the MFA ticket of a login and the codes sent for it for the session tokens
+func (ac *AuthController) VerifyLoginMFAOTP(c *fiber.Ctx) error {
+	var req request.MFAOTPRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	response, err := ac.userService.VerifyLoginMFAOTP(&req, clientInfo(c))
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
 
-	resp, err := ac.userService.Setup2FA(email, phone)
+func (ac *AuthController) Setup2FA(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	resp, err := ac.userService.Setup2FA(uint(userId.(float64)))
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -245,24 +481,27 @@ func (ac *AuthController) Setup2FA(c *fiber.Ctx) error {
 }
 
 func (ac *AuthController) Verify2FA(c *fiber.Ctx) error {
-	email := c.Query("email")
-	phone := c.Query("phone")
-
 	var body struct {
 		Code string `json:"code"`
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
-	verified, err := ac.userService.Verify2FA(email, phone, body.Code)
+	userId := c.Locals("userId")
+	recoveryCodes, err := ac.userService.Verify2FA(uint(userId.(float64)), body.Code)
 	if err != nil {
+		var locked *services.AccountLockedError
+		if errors.As(err, &locked) {
+			return accountLockedResponse(c, locked)
+		}
+		if errors.Is(err, services.ErrInvalidTOTP) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid 2FA code"})
+		}
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
-	if !verified {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid 2FA code"})
-	}
 
-	return c.JSON(fiber.Map{"message": "2FA verified, access granted"})
+	// NOTE: Recovery codes are only returned when this code enabled 2FA
+	return c.JSON(fiber.Map{"message": "2FA verified, access granted", "recovery_codes": recoveryCodes})
 }
 
 func (ac *AuthController) SetPIN(c *fiber.Ctx) error {
@@ -272,9 +511,9 @@ func (ac *AuthController) SetPIN(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
 	}
 
-	err := ac.userService.SetPIN(req.Email, req.Phone, req.PIN)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	userId := c.Locals("userId")
+	if err := ac.userService.SetPIN(uint(userId.(float64)), req.PIN); err != nil {
+		return pinError(c, err)
 	}
 
 	return c.JSON(fiber.Map{"message": "PIN set successfully"})
@@ -287,9 +526,14 @@ func (ac *AuthController) VerifyPIN(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
 	}
 
-	valid, err := ac.userService.VerifyPIN(req.Email, req.Phone, req.PIN)
+	userId := c.Locals("userId")
+	valid, err := ac.userService.VerifyPIN(uint(userId.(float64)), req.PIN)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		var locked *services.AccountLockedError
+		if errors.As(err, &locked) {
+			return accountLockedResponse(c, locked)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	if !valid {
@@ -299,6 +543,189 @@ func (ac *AuthController) VerifyPIN(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"message": "PIN verified"})
 }
 
+func (ac *AuthController) ChangePIN(c *fiber.Ctx) error {
+	var req request.ChangePINRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userId := c.Locals("userId")
+	if err := ac.userService.ChangePIN(uint(userId.(float64)), &req); err != nil {
+		return pinError(c, err)
+	}
+	return c.JSON(fiber.Map{"message": "PIN changed successfully"})
+}
+
+func (ac *AuthController) RequestPINReset(c *fiber.Ctx) error {
+	userId := c.Locals("userId")
+	response, err := ac.userService.RequestPINReset(uint(userId.(float64)), clientInfo(c))
+	if err != nil {
+		var throttled *services.OTPThrottledError
+		if errors.As(err, &throttled) {
+			return otpThrottledResponse(c, throttled)
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+func (ac *AuthController) ResetPIN(c *fiber.Ctx) error {
+	var req request.PINResetRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userId := c.Locals("userId")
+	if err := ac.userService.ResetPIN(uint(userId.(float64)), &req); err != nil {
+		return pinError(c, err)
+	}
+	return c.JSON(fiber.Map{"message": "PIN reset successfully"})
+}
+
+// pinError maps PIN failures: 400 for a rejected new PIN, 409 when a PIN exists, 423 while locked, 401 otherwise
+func pinError(c *fiber.Ctx, err error) error {
+	var locked *services.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		return accountLockedResponse(c, locked)
+	case errors.Is(err, util.ErrPINPolicy):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrPINAlreadySet):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+}
+
+// StepUp exchanges the PIN or a TOTP code of the signed in user for a short-lived elevated token
+func (ac *AuthController) StepUp(c *fiber.Ctx) error {
+	var req request.StepUpRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	token, err := ac.userService.StepUp(c.Locals("claims").(jwt.MapClaims), &req)
+	if err != nil {
+		return secondFactorError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(token)
+}
+
+// VerifyLoginRecovery exchanges the MFA ticket of a login and a recovery code for the session tokens
+func (ac *AuthController) VerifyLoginRecovery(c *fiber.Ctx) error {
+	var req request.MFARecoveryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	tokens, err := ac.userService.VerifyLoginRecovery(&req, clientInfo(c))
+	if err != nil {
+		return secondFactorError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(tokens)
+}
+
+func (ac *AuthController) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	var req request.SecondFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	userId := c.Locals("userId")
+	codes, err := ac.userService.RegenerateRecoveryCodes(uint(userId.(float64)), &req)
+	if err != nil {
+		return secondFactorError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(&response.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (ac *AuthController) Disable2FA(c *fiber.Ctx) error {
+	var req request.SecondFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	userId := c.Locals("userId")
+	if err := ac.userService.Disable2FA(uint(userId.(float64)), &req); err != nil {
+		return secondFactorError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "2FA disabled",
+	})
+}
+
+func (ac *AuthController) Reenroll2FA(c *fiber.Ctx) error {
+	var req request.SecondFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	userId := c.Locals("userId")
+	setup, err := ac.userService.Reenroll2FA(uint(userId.(float64)), &req)
+	if err != nil {
+		return secondFactorError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"secret":  setup.Secret,
+		"qr_code": base64.StdEncoding.EncodeToString(setup.QRCode),
+	})
+}
+
+func (ac *AuthController) ConfirmReenroll2FA(c *fiber.Ctx) error {
+	var req request.TOTPCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	userId := c.Locals("userId")
+	codes, err := ac.userService.ConfirmReenroll2FA(uint(userId.(float64)), req.Code)
+	if err != nil {
+		return secondFactorError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(&response.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// secondFactorError maps a failed TOTP or recovery code check to 423 while locked and 401 otherwise
+func secondFactorError(c *fiber.Ctx, err error) error {
+	var locked *services.AccountLockedError
+	if errors.As(err, &locked) {
+		return accountLockedResponse(c, locked)
+	}
+	status := fiber.StatusBadRequest
+	if errors.Is(err, services.ErrInvalidTOTP) || errors.Is(err, services.ErrInvalidRecoveryCode) {
+		status = fiber.StatusUnauthorized
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
+
 //func (ac *AuthController) CheckLogin(c *fiber.Ctx) error {
 //	var req *request.CheckLogin
 //	if err := c.BodyParser(&req); err != nil {
@@ -1,6 +1,11 @@
 package domain
 
-import "time"
+import (
+	"time"
+	"user_management_ms/util"
+
+	"gorm.io/gorm"
+)
 
 type Passkey struct {
 	ID              uint       `gorm:"primaryKey" json:"id"`
@@ -12,9 +17,23 @@ type Passkey struct {
 	UpdatedAt       *time.Time `gorm:"default:null" json:"updated_at"`
 	AAGUID          []byte     `gorm:"not null" json:"aa_guid"`
 	AttestationType string
-	Authenticator   []byte `gorm:"type:json"`
-	BackupEligible  bool   `gorm:"not null;default:false" json:"backup_eligible"`
-	BackupState     bool   `gorm:"not null;default:false" json:"backup_state"`
+	Authenticator   util.EncryptedBytes `gorm:"type:json"`
+	KeyVersion      *int                `gorm:"column:key_version;default:null" json:"-"`
+	BackupEligible  bool                `gorm:"not null;default:false" json:"backup_eligible"`
+	BackupState     bool                `gorm:"not null;default:false" json:"backup_state"`
+	Nickname        string              `gorm:"size:100;default:null" json:"nickname"`
+	LastUsedAt      *time.Time          `gorm:"default:null" json:"last_used_at"`
+	// NOTE: Taken from the FIDO metadata at registration, empty without metadata for the model
+	AuthenticatorName  string     `gorm:"size:255;default:null" json:"authenticator_name"`
+	CertificationLevel string     `gorm:"size:50;default:null" json:"certification_level"`
+	FlaggedAt          *time.Time `gorm:"default:null" json:"flagged_at"`
+	FlagReason         string     `gorm:"size:255;default:null" json:"flag_reason"`
+}
+
+// BeforeSave records which master key seals the authenticator data
+func (p *Passkey) BeforeSave(tx *gorm.DB) error {
+	p.KeyVersion = SealedKeyVersion(len(p.Authenticator) > 0)
+	return nil
 }
 
 func (Passkey) TableName() string {
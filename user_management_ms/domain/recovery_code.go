@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"size:64;not null" json:"-"`
+	UsedAt    *time.Time `gorm:"default:null" json:"used_at"`
+	CreatedAt *time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (RecoveryCode) TableName() string {
+	return "user_recovery_codes"
+}
@@ -5,31 +5,46 @@ import (
 	"log"
 	"strconv"
 	"time"
+	"user_management_ms/util"
 
 	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
 )
 
 type User struct {
-	Id                 uint       `gorm:"primaryKey" json:"id"`
-	CreatedAt          *time.Time `gorm:"not null;default:CURRENT_TIMESTAMP" json:"created_at"`
-	UpdatedAt          *time.Time `gorm:"default:null" json:"updated_at"`
-	DeletedAt          *time.Time `gorm:"default:null" json:"deleted_at"`
-	Email              string     `gorm:"size:100;not null" json:"email"`
-	Phone              string     `gorm:"size:100;not null" json:"phone"`
-	BirthDate          *time.Time `gorm:"default:NULL" json:"birth_date"`
-	Password           string     `gorm:"size:100;not null" json:"password"`
-	GoogleID           string     `gorm:"size:100;" json:"google_id"`
-	EmailOtp           string     `gorm:"size:100;not null" json:"email_otp"`
-	PhoneOtp           string     `gorm:"size:100;not null" json:"phone_otp"`
-	EmailVerified      bool       `json:"email_verified"`
-	PhoneVerified      bool       `json:"phone_verified"`
-	EmailOtpExpireDate *time.Time `gorm:"default:NULL" json:"email_otp_expire_date"`
-	PhoneOtpExpireDate *time.Time `gorm:"default:NULL" json:"phone_otp_expire_date"`
-	PINHash            string     `gorm:"size:100;default:null" json:"pin_hash"`
-	Is2FAVerified      bool       `gorm:"default:false"`
-	UserType           string     `gorm:"size:100;default:null" json:"user_type"`
-	Google2FASecret    string
-	Passkeys           []Passkey `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user_passkeys"`
+	Id               uint                 `gorm:"primaryKey" json:"id"`
+	CreatedAt        *time.Time           `gorm:"not null;default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt        *time.Time           `gorm:"default:null" json:"updated_at"`
+	DeletedAt        *time.Time           `gorm:"default:null" json:"deleted_at"`
+	Email            string               `gorm:"size:100;not null" json:"email"`
+	Phone            string               `gorm:"size:100;not null" json:"phone"`
+	BirthDate        *time.Time           `gorm:"default:NULL" json:"birth_date"`
+	Password         string               `gorm:"size:100;not null" json:"password"`
+	GoogleID         string               `gorm:"size:100;" json:"google_id"`
+	EmailVerified    bool                 `json:"email_verified"`
+	PhoneVerified    bool                 `json:"phone_verified"`
+	PINHash          string               `gorm:"size:100;default:null" json:"pin_hash"`
+	Is2FAVerified    bool                 `gorm:"default:false"`
+	UserType         string               `gorm:"size:100;default:null" json:"user_type"`
+	Google2FASecret  util.EncryptedString `gorm:"column:google2_fa_secret" json:"-"`
+	SecretKeyVersion *int                 `gorm:"column:secret_key_version;default:null" json:"-"`
+	TOTPLastStep     *int64               `gorm:"column:totp_last_step;default:null" json:"-"`
+	Passkeys         []Passkey            `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user_passkeys"`
+}
+
+// BeforeSave records which master key seals the encrypted columns of the row
+func (u *User) BeforeSave(tx *gorm.DB) error {
+	u.SecretKeyVersion = SealedKeyVersion(u.Google2FASecret != "")
+	return nil
+}
+
+// SealedKeyVersion returns the master key version new values are sealed with, nil when nothing is encrypted
+func SealedKeyVersion(hasValue bool) *int {
+	version := util.CurrentKeyVersion()
+	if !hasValue || version == 0 {
+		return nil
+	}
+	return &version
 }
 
 func (u User) WebAuthnID() []byte {
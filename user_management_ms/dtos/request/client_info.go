@@ -0,0 +1,8 @@
+package request
+
+type ClientInfo struct {
+	DeviceName string `json:"device_name"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	Location   string `json:"location,omitempty"`
+}
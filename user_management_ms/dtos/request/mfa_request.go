@@ -0,0 +1,28 @@
+package request
+
+type MFAVerifyRequest struct {
+	MfaTicket string `json:"mfa_ticket" validate:"required"`
+	Code      string `json:"code" validate:"required"`
+}
+
+// MFAOTPRequest answers the OTP challenge of an MFA ticket, with a code for every channel it was sent to
+type MFAOTPRequest struct {
+	MfaTicket string `json:"mfa_ticket" validate:"required"`
+	EmailOTP  string `json:"email_otp"`
+	PhoneOTP  string `json:"phone_otp"`
+}
+
+type MFARecoveryRequest struct {
+	MfaTicket    string `json:"mfa_ticket" validate:"required"`
+	RecoveryCode string `json:"recovery_code" validate:"required"`
+}
+
+// SecondFactorRequest proves possession of the second factor with a TOTP code or a recovery code
+type SecondFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
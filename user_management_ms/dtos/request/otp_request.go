@@ -14,14 +14,17 @@ type OTPRequestEmail struct {
 }
 
 type EmailAndPhoneOTP struct {
-	EmailOTP string `json:"email_otp" validate:"required"`
-	PhoneOTP string `json:"phone_otp" validate:"required"`
+	ChallengeId string `json:"challenge_id" validate:"required"`
+	EmailOTP    string `json:"email_otp" validate:"required"`
+	PhoneOTP    string `json:"phone_otp" validate:"required"`
 }
 
 type PhoneOTP struct {
-	PhoneOTP string `json:"phone_otp" validate:"required"`
+	ChallengeId string `json:"challenge_id" validate:"required"`
+	PhoneOTP    string `json:"phone_otp" validate:"required"`
 }
 
 type EmailOTP struct {
-	EmailOTP string `json:"email_otp" validate:"required"`
+	ChallengeId string `json:"challenge_id" validate:"required"`
+	EmailOTP    string `json:"email_otp" validate:"required"`
 }
@@ -1,9 +1,30 @@
 package request
 
 type StartPasskeyRegistrationRequest struct {
-	UserId uint `json:"user_id" validate:"required"`
+	UserId uint   `json:"user_id" validate:"required"`
+	Client string `json:"-"`
 }
 
 type FinishPasskeyRegistrationRequest struct {
 	UserId uint `json:"user_id" validate:"required"`
 }
+
+type RenamePasskeyRequest struct {
+	Nickname string `json:"nickname" validate:"required,max=100"`
+}
+
+// PasskeyLoginStartRequest is optional, with an email the assertion is bound to the passkeys of that user,
+// conditional asks for autofill (conditional mediation) options for the username field
+type PasskeyLoginStartRequest struct {
+	Email       string `json:"email" validate:"omitempty,email"`
+	Conditional bool   `json:"conditional"`
+	Client      string `json:"-"`
+}
+
+// PasskeyTransactionRequest describes the operation the user approves, e.g. action "withdrawal" with
+// payload {"amount": "0.5", "currency": "BTC", "address": "bc1..."}
+type PasskeyTransactionRequest struct {
+	Action  string            `json:"action" validate:"required,max=64"`
+	Payload map[string]string `json:"payload" validate:"required,min=1"`
+	Client  string            `json:"-"`
+}
@@ -1,7 +1,18 @@
 package request
 
 type PINRequest struct {
-	Email string `json:"email"`
-	Phone string `json:"phone"`
-	PIN   string `json:"pin"`
+	PIN string `json:"pin"`
+}
+
+type ChangePINRequest struct {
+	OldPIN string `json:"old_pin" validate:"required"`
+	NewPIN string `json:"new_pin" validate:"required"`
+}
+
+// PINResetRequest sets a new PIN with the email and phone codes of a pin_reset challenge
+type PINResetRequest struct {
+	ChallengeId string `json:"challenge_id" validate:"required"`
+	EmailOTP    string `json:"email_otp" validate:"required"`
+	PhoneOTP    string `json:"phone_otp" validate:"required"`
+	NewPIN      string `json:"new_pin" validate:"required"`
 }
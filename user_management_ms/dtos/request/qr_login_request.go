@@ -0,0 +1,12 @@
+package request
+
+const (
+	QrFormatPNG = "png"
+	QrFormatSVG = "svg"
+	QrFormatRaw = "raw"
+)
+
+// QrLoginRequest picks how the QR code is returned, raw leaves the rendering to the client
+type QrLoginRequest struct {
+	Format string `query:"format" validate:"omitempty,oneof=png svg raw"`
+}
@@ -0,0 +1,11 @@
+package request
+
+import "time"
+
+type SecurityEvent struct {
+	Type       string            `json:"type"`
+	UserId     uint              `json:"user_id"`
+	Reason     string            `json:"reason"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	OccurredAt time.Time         `json:"occurred_at"`
+}
@@ -0,0 +1,8 @@
+package request
+
+// StepUpRequest re-authenticates the user of a session, Method is "pin" or "totp"
+type StepUpRequest struct {
+	Method string `json:"method" validate:"required,oneof=pin totp"`
+	PIN    string `json:"pin" validate:"required_if=Method pin"`
+	Code   string `json:"code" validate:"required_if=Method totp"`
+}
@@ -4,3 +4,7 @@ type TwoFASetupResponse struct {
 	Secret string `json:"secret"`
 	QRCode []byte `json:"qr_code"` // optional
 }
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
@@ -9,9 +9,11 @@ type OTPResponse struct {
 }
 
 type SendOTPResponse struct {
-	Email  string `json:"email"`
-	Phone  string `json:"phone"`
-	Status string `json:"status"`
+	Email       string `json:"email"`
+	Phone       string `json:"phone"`
+	Status      string `json:"status"`
+	ChallengeId string `json:"challenge_id,omitempty"`
+	ResendAfter int    `json:"resend_after,omitempty"`
 }
 
 type RegisterResponse struct {
@@ -22,6 +24,8 @@ type RegisterResponse struct {
 	PhoneVerified bool   `json:"phone_verified"`
 	Completed     bool   `json:"completed"`
 	Status        string `json:"status"`
+	ChallengeId   string `json:"challenge_id,omitempty"`
+	ResendAfter   int    `json:"resend_after,omitempty"`
 }
 
 type OTPResponsePhone struct {
@@ -29,6 +33,8 @@ type OTPResponsePhone struct {
 	PhoneVerified bool   `json:"phone_verified"`
 	Status        string `json:"status"`
 	Message       string `json:"message"`
+	ChallengeId   string `json:"challenge_id,omitempty"`
+	ResendAfter   int    `json:"resend_after,omitempty"`
 }
 
 type OTPResponseEmail struct {
@@ -36,6 +42,8 @@ type OTPResponseEmail struct {
 	EmailVerified bool   `json:"email_verified"`
 	Status        string `json:"status"`
 	Message       string `json:"message"`
+	ChallengeId   string `json:"challenge_id,omitempty"`
+	ResendAfter   int    `json:"resend_after,omitempty"`
 }
 
 type GoogleResponse struct {
@@ -43,9 +51,13 @@ type GoogleResponse struct {
 	Phone         string `json:"phone"`
 	PhoneVerified bool   `json:"phone_verified"`
 	Status        string `json:"status"`
+	ChallengeId   string `json:"challenge_id,omitempty"`
+	ResendAfter   int    `json:"resend_after,omitempty"`
 }
 
 type LoginResponse struct {
-	Email string `json:"email"`
-	Phone string `json:"phone"`
+	Email       string `json:"email"`
+	Phone       string `json:"phone"`
+	ChallengeId string `json:"challenge_id"`
+	ResendAfter int    `json:"resend_after,omitempty"`
 }
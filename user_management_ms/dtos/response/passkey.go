@@ -0,0 +1,25 @@
+package response
+
+import "time"
+
+type Passkey struct {
+	Id                 uint       `json:"id"`
+	Nickname           string     `json:"nickname"`
+	AuthenticatorName  string     `json:"authenticator_name"`
+	AAGUID             string     `json:"aaguid"`
+	CreatedAt          *time.Time `json:"created_at"`
+	LastUsedAt         *time.Time `json:"last_used_at"`
+	BackupEligible     bool       `json:"backup_eligible"`
+	BackupState        bool       `json:"backup_state"`
+	CertificationLevel string     `json:"certification_level,omitempty"`
+	FlaggedAt          *time.Time `json:"flagged_at,omitempty"`
+	FlagReason         string     `json:"flag_reason,omitempty"`
+}
+
+// TransactionReceipt is the signed approval of a transaction, a JWT with token_use tx_receipt verifiable with the JWKS
+type TransactionReceipt struct {
+	TransactionId string `json:"transaction_id"`
+	Receipt       string `json:"receipt"`
+	PayloadHash   string `json:"payload_hash"`
+	ExpiresIn     int    `json:"expires_in"`
+}
@@ -1,14 +1,41 @@
 package response
 
+import "time"
+
 type QrLoginStatus string
 
 const (
 	StatusPending  QrLoginStatus = "PENDING"
+	StatusScanned  QrLoginStatus = "SCANNED"
 	StatusApproved QrLoginStatus = "APPROVED"
-	StatusExpired  QrLoginStatus = "EXPIRED"
+	// StatusRejected means the phone denied the login, StatusCancelled that the desktop gave up on it
+	StatusRejected  QrLoginStatus = "REJECTED"
+	StatusCancelled QrLoginStatus = "CANCELLED"
+	StatusExpired   QrLoginStatus = "EXPIRED"
 )
 
 type QrLoginResponse struct {
 	Status QrLoginStatus `json:"status"`
 	Tokens *Tokens       `json:"tokens,omitempty"`
 }
+
+// QrLoginChallenge is returned to the desktop only, the secret is needed to watch the login and collect the tokens.
+// Payload is the link encoded in the QR code, the image is rendered in the requested format unless it is raw.
+type QrLoginChallenge struct {
+	SessionId string `json:"sessionId"`
+	Secret    string `json:"secret"`
+	Payload   string `json:"payload"`
+	Base64PNG string `json:"base64png,omitempty"`
+	SVG       string `json:"svg,omitempty"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// QrLoginScan shows the phone which device asked for the login before it is approved
+type QrLoginScan struct {
+	SessionId   string    `json:"sessionId"`
+	DeviceName  string    `json:"device_name"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	Location    string    `json:"location,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+}
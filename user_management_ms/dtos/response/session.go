@@ -0,0 +1,14 @@
+package response
+
+import "time"
+
+type Session struct {
+	SessionId   string    `json:"session_id"`
+	DeviceName  string    `json:"device_name"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	LoginMethod string    `json:"login_method"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	Current     bool      `json:"current"`
+}
@@ -3,4 +3,18 @@ package response
 type Tokens struct {
 	AccessToken  string
 	RefreshToken string
+	// NOTE: Set instead of the token pair when the user still has to pass a second factor. MfaFactor totp
+	// goes to /auth/mfa/verify, otp to /auth/mfa/otp with the codes sent for ChallengeId.
+	MfaRequired bool   `json:",omitempty"`
+	MfaTicket   string `json:",omitempty"`
+	MfaFactor   string `json:",omitempty"`
+	ChallengeId string `json:",omitempty"`
+	ResendAfter int    `json:",omitempty"`
+}
+
+// StepUpToken is an elevated access token for sensitive operations, it is not refreshable
+type StepUpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	Acr         string `json:"acr"`
 }
@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AdminKeyMiddleware guards internal endpoints with the X-Admin-Key header, they are disabled while no key is configured
+func AdminKeyMiddleware(apiKey string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		provided := c.Get("X-Admin-Key")
+		if apiKey == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) != 1 {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Forbidden",
+			})
+		}
+		return c.Next()
+	}
+}
@@ -41,13 +41,16 @@ func LoggingMiddleware(logger *zap.Logger) fiber.Handler {
 		err := c.Next()
 		duration := time.Since(start)
 		statusCode := c.Response().StatusCode()
-		responseBody := c.Response().Body()
 
 		responseErr := struct {
 			ResponseErr string `json:"error"`
 		}{}
-		if jsonErr := json.Unmarshal(responseBody, &responseErr); jsonErr != nil {
-			responseErr.ResponseErr = ""
+		// NOTE: Reading a streamed body (Server-Sent Events) would drain the stream here and hold it back
+		// from the client until it ends, only buffered bodies carry an error to log
+		if !c.Response().IsBodyStream() {
+			if jsonErr := json.Unmarshal(c.Response().Body(), &responseErr); jsonErr != nil {
+				responseErr.ResponseErr = ""
+			}
 		}
 
 		fields := []zap.Field{
@@ -1,34 +1,90 @@
 package middleware
 
 import (
+	"math"
+	"strconv"
+	"strings"
 	"time"
+	"user_management_ms/services"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/log"
 )
 
+// RateLimitKey returns one part of the key a request is counted under, empty parts are skipped
+type RateLimitKey func(c *fiber.Ctx) string
+
+// KeyByIP limits per client address
+func KeyByIP(c *fiber.Ctx) string {
+	return "ip:" + c.IP()
+}
+
+// KeyByRoute limits per route pattern, so /qr/:sessionId shares one counter
+func KeyByRoute(c *fiber.Ctx) string {
+	return "route:" + c.Method() + ":" + c.Route().Path
+}
+
+// KeyByIdentity limits per email and phone of the body, falling back to the query string
+func KeyByIdentity(c *fiber.Ctx) string {
+	var identity struct {
+		Email string `json:"email" form:"email"`
+		Phone string `json:"phone" form:"phone"`
+	}
+	if len(c.Body()) > 0 {
+		_ = c.BodyParser(&identity)
+	}
+	if identity.Email == "" {
+		identity.Email = c.Query("email", c.Params("email"))
+	}
+	if identity.Phone == "" {
+		identity.Phone = c.Query("phone")
+	}
+	if identity.Email == "" && identity.Phone == "" {
+		return ""
+	}
+	return "id:" + strings.ToLower(strings.TrimSpace(identity.Email)) + "|" + strings.TrimSpace(identity.Phone)
+}
+
 // GlobalRateLimiter returns a pre-configured limiter middleware
-func GlobalRateLimiter() fiber.Handler {
-	return limiter.New(limiter.Config{
-		Max:        10,               // 10 requests
-		Expiration: 30 * time.Second, // per 30s window
-		LimitReached: func(c *fiber.Ctx) error {
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"error": "Too many requests, slow down.",
-			})
-		},
-	})
+func GlobalRateLimiter(redis services.IRedisService) fiber.Handler {
+	return newRateLimiter(redis, 10, 30*time.Second, "Too many requests, slow down.", KeyByIP) // 10 requests per 30s window
+}
+
+// RouteRateLimiter allows you to set custom limits per route, keyed by IP + route + identity unless keys are given
+func RouteRateLimiter(redis services.IRedisService, max int, window time.Duration, keys ...RateLimitKey) fiber.Handler {
+	if len(keys) == 0 {
+		keys = []RateLimitKey{KeyByIP, KeyByRoute, KeyByIdentity}
+	}
+	return newRateLimiter(redis, max, window, "Rate limit exceeded", keys...)
 }
 
-// RouteRateLimiter allows you to set custom limits per route
-func RouteRateLimiter(max int, window time.Duration) fiber.Handler {
-	return limiter.New(limiter.Config{
-		Max:        max,
-		Expiration: window,
-		LimitReached: func(c *fiber.Ctx) error {
+// NOTE: Counters live in Redis so limits are shared by all instances and survive restarts
+func newRateLimiter(redis services.IRedisService, max int, window time.Duration, message string, keys ...RateLimitKey) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if part := key(c); part != "" {
+				parts = append(parts, part)
+			}
+		}
+
+		result, err := redis.HitRateLimit(strings.Join(parts, ":"), max, window)
+		if err != nil {
+			// NOTE: Fail open, an unavailable Redis must not take the whole API down
+			log.Warn("rate limiter unavailable: ", err)
+			return c.Next()
+		}
+
+		reset := strconv.Itoa(int(math.Ceil(result.Reset.Seconds())))
+		c.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Set("RateLimit-Reset", reset)
+		if !result.Allowed {
+			c.Set(fiber.HeaderRetryAfter, reset)
 			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"error": "Rate limit exceeded",
+				"error": message,
 			})
-		},
-	})
+		}
+		return c.Next()
+	}
 }
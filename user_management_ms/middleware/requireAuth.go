@@ -1,23 +1,17 @@
 package middleware
 
 import (
+	"strconv"
 	"strings"
 	"time"
-	"user_management_ms/config"
 	"user_management_ms/services"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleware() fiber.Handler {
+func AuthMiddleware(tokens services.ITokenService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		secret := config.Conf.Application.Security.Secret
-		issuer := config.Conf.Application.Security.Issuer
-		acctm := config.Conf.Application.Security.TokenValidityInSeconds
-		reftm := config.Conf.Application.Security.TokenValidityInSecondsForRememberMe
-
-		jwt := services.NewJWTService([]byte(secret), issuer, time.Duration(acctm), time.Duration(reftm))
-
 		authHeader := c.Get("Authorization")
 		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -27,27 +21,44 @@ func AuthMiddleware() fiber.Handler {
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-		token, err := jwt.ParseJWT(tokenString)
+		// NOTE: Signature, expiry and revocation (logout, denylist) are checked together
+		claims, err := tokens.ValidateAccessToken(tokenString)
 		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Token parse error",
+				"error": "Invalid token",
 			})
 		}
+		c.Locals("userId", claims["sub"])
+		c.Locals("claims", claims)
+
+		return c.Next()
+	}
+}
 
-		if !token.Valid {
+// RequireACR guards sensitive operations, it must run after AuthMiddleware. The token needs an acr of at
+// least level and an auth_time within maxAge, otherwise the client is told to step up and retry.
+func RequireACR(level int, maxAge time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := c.Locals("claims").(jwt.MapClaims)
+		if !ok {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token",
+				"error": "Missing or invalid token",
 			})
 		}
-
-		claims, err := jwt.GetClaims(token)
+		acrClaim, _ := claims["acr"].(string)
+		acr, err := strconv.Atoi(acrClaim)
 		if err != nil {
+			// NOTE: Tokens minted before acr existed are regular session tokens
+			acr = services.ACRLogin
+		}
+		authTime, _ := claims["auth_time"].(float64)
+		if acr < level || authTime == 0 || time.Since(time.Unix(int64(authTime), 0)) > maxAge {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token",
+				"error":            "Step-up authentication required",
+				"step_up_required": true,
+				"acr":              strconv.Itoa(level),
 			})
 		}
-		c.Locals("userId", claims["sub"])
-
 		return c.Next()
 	}
 }
@@ -12,7 +12,7 @@ type IGoogleRepository interface {
 	FindUserByPhoneNumber(db *gorm.DB, phone string) (*domain.User, error)
 	Create(db *gorm.DB, entity *domain.User) (*domain.User, error)
 	FindUserByEmail(db *gorm.DB, email string) (*domain.User, error)
-	UpdateGoogleUserPhone(db *gorm.DB, email, phone, phoneOtp string, expire time.Time) (*domain.User, error)
+	UpdateGoogleUserPhone(db *gorm.DB, email, phone string) (*domain.User, error)
 	GetUserWithEmailAndPhone(db *gorm.DB, email string, phone string) (*domain.User, error)
 	UpdateUserBirthdayAndPassword(db *gorm.DB, email, password string, birthDay *time.Time) (*domain.User, error)
 	UpdateUserVerifyStatus(db *gorm.DB, email string, verify bool) (*domain.User, error)
@@ -58,7 +58,7 @@ func (s *GoogleRepository) FindUserByEmail(db *gorm.DB, email string) (*domain.U
 	return &user, nil
 }
 
-func (s *GoogleRepository) UpdateGoogleUserPhone(db *gorm.DB, email, phone, phoneOtp string, expire time.Time) (*domain.User, error) {
+func (s *GoogleRepository) UpdateGoogleUserPhone(db *gorm.DB, email, phone string) (*domain.User, error) {
 	user := domain.User{}
 	err := db.Model(&user).Where("email=?", email).First(&user).Error
 	if err != nil {
@@ -67,8 +67,6 @@ func (s *GoogleRepository) UpdateGoogleUserPhone(db *gorm.DB, email, phone, phon
 	if phone != "" {
 		user.Phone = phone
 	}
-	user.PhoneOtp = phoneOtp
-	user.PhoneOtpExpireDate = &expire
 	return &user, db.Save(&user).Error
 }
 
@@ -12,6 +12,8 @@ import (
 
 type IUserRepository interface {
 	GetByID(db *gorm.DB, id uint) (*domain.User, error)
+	GetByIDWithPasskeys(db *gorm.DB, id uint) (*domain.User, error)
+	GetUserByEmailWithPasskeys(db *gorm.DB, email string) (*domain.User, error)
 	Create(db *gorm.DB, entity *domain.User) (*domain.User, error)
 	Update(db *gorm.DB, entity *domain.User) error
 	Delete(db *gorm.DB, id uint) error
@@ -19,13 +21,23 @@ type IUserRepository interface {
 	GetUserByEmail(db *gorm.DB, email string) (*domain.User, error)
 	UpdateUserPasswordAndBirthDate(db *gorm.DB, email, hasPassword string, birthDate *time.Time) (*domain.User, error)
 	GetUserByEmailOrPhone(db *gorm.DB, email, phone string) (*domain.User, error)
-	SaveUserOTPs(db *gorm.DB, email string, phone string, duration time.Duration) error
-	DeteUserOtpAndExpireDate(db *gorm.DB, user *domain.User) error
-	SetUserEmailPhoneOtpAndExpireDates(db *gorm.DB, user *domain.User, emailOtp, phoneOtp string) error
-	SavePasskey(db *gorm.DB, authBytes []byte, userID uint, cred *webauthn.Credential) error
+	SavePasskey(db *gorm.DB, authBytes []byte, userID uint, cred *webauthn.Credential, authenticatorName, certificationLevel string) error
 	GetCompletedUsersByEmailAndPhone(db *gorm.DB, email string, phone string) (*domain.User, error)
-	UpdatePasskeyAfterLogin(db *gorm.DB, credID []byte, auth []byte, signCount uint32) error
+	UpdatePasskeyAfterLogin(db *gorm.DB, credID []byte, auth []byte, signCount uint32, backupState bool) error
+	FlagPasskey(db *gorm.DB, credID []byte, reason string) error
+	ListPasskeys(db *gorm.DB, userID uint) ([]domain.Passkey, error)
+	RenamePasskey(db *gorm.DB, userID, passkeyID uint, nickname string) (bool, error)
+	DeletePasskey(db *gorm.DB, userID, passkeyID uint, keepLast bool) (bool, error)
 	FindUserByCredentialID(db *gorm.DB, credID []byte) (*domain.User, error)
+	MarkTOTPStepUsed(db *gorm.DB, userID uint, step int64) (bool, error)
+	ReplaceRecoveryCodes(db *gorm.DB, userID uint, codeHashes []string) error
+	UseRecoveryCode(db *gorm.DB, userID uint, codeHash string) (bool, error)
+	CountUnusedRecoveryCodes(db *gorm.DB, userID uint) (int64, error)
+	DeleteRecoveryCodes(db *gorm.DB, userID uint) error
+	FindUsersWithStaleSecrets(db *gorm.DB, keyVersion int, afterID uint, limit int) ([]domain.User, error)
+	ReencryptUserSecrets(db *gorm.DB, user *domain.User, keyVersion int) (bool, error)
+	FindPasskeysWithStaleKeys(db *gorm.DB, keyVersion int, afterID uint, limit int) ([]domain.Passkey, error)
+	ReencryptPasskey(db *gorm.DB, passkey *domain.Passkey, keyVersion int) (bool, error)
 }
 type UserRepository struct {
 }
@@ -42,6 +54,16 @@ func (u *UserRepository) GetByID(db *gorm.DB, id uint) (*domain.User, error) {
 	return &user, nil
 }
 
+// GetByIDWithPasskeys loads the user together with the registered passkeys, needed for WebAuthn assertions
+func (u *UserRepository) GetByIDWithPasskeys(db *gorm.DB, id uint) (*domain.User, error) {
+	var user domain.User
+	err := db.Preload("Passkeys").First(&user, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (u *UserRepository) Create(db *gorm.DB, entity *domain.User) (*domain.User, error) {
 	return entity, db.Create(entity).Error
 }
@@ -72,6 +94,15 @@ func (u *UserRepository) GetUserByEmail(db *gorm.DB, email string) (*domain.User
 	return &user, nil
 }
 
+func (u *UserRepository) GetUserByEmailWithPasskeys(db *gorm.DB, email string) (*domain.User, error) {
+	var user domain.User
+	err := db.Preload("Passkeys").Where("email=?", email).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (u *UserRepository) UpdateUserPasswordAndBirthDate(db *gorm.DB, email, hashPassword string, birthDate *time.Time) (*domain.User, error) {
 	var user *domain.User
 	err := db.Where("email=?", email).First(&user).Error
@@ -91,49 +122,19 @@ func (u *UserRepository) GetUserByEmailOrPhone(db *gorm.DB, email, phone string)
 	return &user, nil
 }
 
-func (u *UserRepository) SaveUserOTPs(db *gorm.DB, email string, phone string, duration time.Duration) error {
-	otpEmail := util.GenerateOTP()
-	otpPhone := util.GenerateOTP()
-	expire := time.Now().Add(duration)
-
-	return db.Model(&domain.User{}).
-		Where("email = ? AND phone = ?", email, phone).
-		Updates(map[string]interface{}{
-			"email_otp":                    otpEmail,
-			"email_otp_expire_date":        expire,
-			"phone_number_otp":             otpPhone,
-			"phone_number_otp_expire_date": expire,
-		}).Error
-}
-
-func (u *UserRepository) DeteUserOtpAndExpireDate(db *gorm.DB, user *domain.User) error {
-	user.PhoneOtp = ""
-	user.EmailOtp = ""
-	user.EmailOtpExpireDate = nil
-	user.PhoneOtpExpireDate = nil
-	return db.Save(user).Error
-}
-
-func (u *UserRepository) SetUserEmailPhoneOtpAndExpireDates(db *gorm.DB, user *domain.User, emailOtp, phoneOtp string) error {
-	user.EmailOtp = emailOtp
-	user.PhoneOtp = phoneOtp
-	t := time.Now().Add(5 * time.Minute)
-	user.EmailOtpExpireDate = &t
-	user.PhoneOtpExpireDate = &t
-	return db.Save(user).Error
-}
-
-func (u *UserRepository) SavePasskey(db *gorm.DB, authBytes []byte, userID uint, cred *webauthn.Credential) error {
+func (u *UserRepository) SavePasskey(db *gorm.DB, authBytes []byte, userID uint, cred *webauthn.Credential, authenticatorName, certificationLevel string) error {
 	passkey := domain.Passkey{
-		UserID:          userID,
-		CredentialID:    cred.ID,
-		PublicKey:       cred.PublicKey,
-		SignCount:       cred.Authenticator.SignCount,
-		AAGUID:          cred.Authenticator.AAGUID,
-		AttestationType: cred.AttestationType,
-		BackupState:     cred.Flags.BackupState,
-		BackupEligible:  cred.Flags.BackupEligible,
-		Authenticator:   authBytes,
+		UserID:             userID,
+		CredentialID:       cred.ID,
+		PublicKey:          cred.PublicKey,
+		SignCount:          cred.Authenticator.SignCount,
+		AAGUID:             cred.Authenticator.AAGUID,
+		AttestationType:    cred.AttestationType,
+		BackupState:        cred.Flags.BackupState,
+		BackupEligible:     cred.Flags.BackupEligible,
+		Authenticator:      authBytes,
+		AuthenticatorName:  authenticatorName,
+		CertificationLevel: certificationLevel,
 	}
 
 	if err := db.Create(&passkey).Error; err != nil {
@@ -151,14 +152,49 @@ func (u *UserRepository) GetCompletedUsersByEmailAndPhone(db *gorm.DB, email str
 	return &user, nil
 }
 
-func (u *UserRepository) UpdatePasskeyAfterLogin(db *gorm.DB, credID []byte, auth []byte, signCount uint32) error {
+func (u *UserRepository) UpdatePasskeyAfterLogin(db *gorm.DB, credID []byte, auth []byte, signCount uint32, backupState bool) error {
+	authenticator := util.EncryptedBytes(auth)
 	return db.Model(&domain.Passkey{}).
 		Where("credential_id = ?", credID).
 		Updates(map[string]interface{}{
-			"authenticator": auth,
+			"authenticator": authenticator,
+			"key_version":   domain.SealedKeyVersion(len(auth) > 0),
 			"sign_count":    signCount,
+			"backup_state":  backupState,
+			"last_used_at":  time.Now(),
 		}).Error
 }
+
+func (u *UserRepository) FlagPasskey(db *gorm.DB, credID []byte, reason string) error {
+	return db.Model(&domain.Passkey{}).
+		Where("credential_id = ?", credID).
+		Updates(map[string]interface{}{"flagged_at": time.Now(), "flag_reason": reason}).Error
+}
+
+func (u *UserRepository) ListPasskeys(db *gorm.DB, userID uint) ([]domain.Passkey, error) {
+	var passkeys []domain.Passkey
+	err := db.Where("user_id = ?", userID).Order("created_at").Find(&passkeys).Error
+	return passkeys, err
+}
+
+// RenamePasskey sets the nickname of a passkey of the user, it reports false when the user has no such passkey
+func (u *UserRepository) RenamePasskey(db *gorm.DB, userID, passkeyID uint, nickname string) (bool, error) {
+	result := db.Model(&domain.Passkey{}).
+		Where("id = ? AND user_id = ?", passkeyID, userID).
+		Updates(map[string]interface{}{"nickname": nickname, "updated_at": time.Now()})
+	return result.RowsAffected == 1, result.Error
+}
+
+// DeletePasskey removes a passkey of the user. With keepLast the delete only happens while the user has
+// another passkey, checked in the same statement so concurrent deletes cannot remove them all.
+func (u *UserRepository) DeletePasskey(db *gorm.DB, userID, passkeyID uint, keepLast bool) (bool, error) {
+	query := db.Where("id = ? AND user_id = ?", passkeyID, userID)
+	if keepLast {
+		query = query.Where("(SELECT COUNT(*) FROM user_passkeys WHERE user_id = ?) > 1", userID)
+	}
+	result := query.Delete(&domain.Passkey{})
+	return result.RowsAffected == 1, result.Error
+}
 func (u *UserRepository) FindUserByCredentialID(db *gorm.DB, credentialID []byte) (*domain.User, error) {
 	var user domain.User
 
@@ -174,3 +210,99 @@ func (u *UserRepository) FindUserByCredentialID(db *gorm.DB, credentialID []byte
 
 	return &user, nil
 }
+
+// MarkTOTPStepUsed records the time-step of an accepted TOTP code. It reports false when the
+// step is not newer than the last accepted one, which means the code is being replayed.
+func (u *UserRepository) MarkTOTPStepUsed(db *gorm.DB, userID uint, step int64) (bool, error) {
+	result := db.Model(&domain.User{}).
+		Where("id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)", userID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ReplaceRecoveryCodes invalidates the previous recovery codes of the user and stores the new ones
+func (u *UserRepository) ReplaceRecoveryCodes(db *gorm.DB, userID uint, codeHashes []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&domain.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		codes := make([]domain.RecoveryCode, len(codeHashes))
+		for i, hash := range codeHashes {
+			codes[i] = domain.RecoveryCode{UserID: userID, CodeHash: hash}
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// UseRecoveryCode marks an unused code as used, the conditional update makes each code work only once
+func (u *UserRepository) UseRecoveryCode(db *gorm.DB, userID uint, codeHash string) (bool, error) {
+	result := db.Model(&domain.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (u *UserRepository) CountUnusedRecoveryCodes(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&domain.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+func (u *UserRepository) DeleteRecoveryCodes(db *gorm.DB, userID uint) error {
+	return db.Where("user_id = ?", userID).Delete(&domain.RecoveryCode{}).Error
+}
+
+// FindUsersWithStaleSecrets pages (by id) through users whose secrets are not sealed with keyVersion
+func (u *UserRepository) FindUsersWithStaleSecrets(db *gorm.DB, keyVersion int, afterID uint, limit int) ([]domain.User, error) {
+	var users []domain.User
+	err := db.Where("id > ? AND google2_fa_secret IS NOT NULL AND google2_fa_secret <> ''", afterID).
+		Where("secret_key_version IS NULL OR secret_key_version <> ?", keyVersion).
+		Order("id").Limit(limit).Find(&users).Error
+	return users, err
+}
+
+// ReencryptUserSecrets writes the secrets back sealed with keyVersion. The update only applies while
+// the row still has the key version it was read with, so a concurrent change of the secret wins.
+func (u *UserRepository) ReencryptUserSecrets(db *gorm.DB, user *domain.User, keyVersion int) (bool, error) {
+	query := db.Model(&domain.User{}).Where("id = ?", user.Id)
+	if user.SecretKeyVersion == nil {
+		query = query.Where("secret_key_version IS NULL")
+	} else {
+		query = query.Where("secret_key_version = ?", *user.SecretKeyVersion)
+	}
+	result := query.Updates(map[string]interface{}{
+		"google2_fa_secret":  user.Google2FASecret,
+		"secret_key_version": keyVersion,
+	})
+	return result.RowsAffected == 1, result.Error
+}
+
+// FindPasskeysWithStaleKeys pages (by id) through passkeys whose authenticator is not sealed with keyVersion
+func (u *UserRepository) FindPasskeysWithStaleKeys(db *gorm.DB, keyVersion int, afterID uint, limit int) ([]domain.Passkey, error) {
+	var passkeys []domain.Passkey
+	err := db.Where("id > ? AND authenticator IS NOT NULL", afterID).
+		Where("key_version IS NULL OR key_version <> ?", keyVersion).
+		Order("id").Limit(limit).Find(&passkeys).Error
+	return passkeys, err
+}
+
+// ReencryptPasskey writes the authenticator back sealed with keyVersion, see ReencryptUserSecrets
+func (u *UserRepository) ReencryptPasskey(db *gorm.DB, passkey *domain.Passkey, keyVersion int) (bool, error) {
+	query := db.Model(&domain.Passkey{}).Where("id = ?", passkey.ID)
+	if passkey.KeyVersion == nil {
+		query = query.Where("key_version IS NULL")
+	} else {
+		query = query.Where("key_version = ?", *passkey.KeyVersion)
+	}
+	result := query.Updates(map[string]interface{}{
+		"authenticator": passkey.Authenticator,
+		"key_version":   keyVersion,
+	})
+	return result.RowsAffected == 1, result.Error
+}
@@ -0,0 +1,5 @@
+ALTER TABLE users
+    ADD email_otp             NVARCHAR(100),
+        phone_otp             NVARCHAR(100),
+        email_otp_expire_date DATETIME2 DEFAULT NULL,
+        phone_otp_expire_date DATETIME2 DEFAULT NULL;
@@ -0,0 +1,11 @@
+-- OTP codes are kept as hashed challenges in Redis, drop the plaintext columns
+DECLARE @sql NVARCHAR(MAX) = N'';
+SELECT @sql += N'ALTER TABLE users DROP CONSTRAINT ' + QUOTENAME(dc.name) + N';'
+FROM sys.default_constraints dc
+         JOIN sys.columns c ON c.default_object_id = dc.object_id AND c.object_id = dc.parent_object_id
+WHERE dc.parent_object_id = OBJECT_ID(N'users')
+  AND c.name IN (N'email_otp_expire_date', N'phone_otp_expire_date');
+EXEC sp_executesql @sql;
+
+ALTER TABLE users
+    DROP COLUMN email_otp, phone_otp, email_otp_expire_date, phone_otp_expire_date;
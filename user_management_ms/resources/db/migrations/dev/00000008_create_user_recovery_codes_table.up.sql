@@ -0,0 +1,10 @@
+-- one-time 2FA recovery codes, only the SHA-256 of a code is stored
+CREATE TABLE user_recovery_codes
+(
+    id         INT IDENTITY (1,1) PRIMARY KEY,
+    user_id    INT         NOT NULL FOREIGN KEY REFERENCES users (id) ON DELETE CASCADE,
+    code_hash  VARCHAR(64) NOT NULL,
+    used_at    DATETIME2   DEFAULT NULL,
+    created_at DATETIME2   NOT NULL DEFAULT GETDATE()
+);
+CREATE INDEX ix_user_recovery_codes_user_id ON user_recovery_codes (user_id);
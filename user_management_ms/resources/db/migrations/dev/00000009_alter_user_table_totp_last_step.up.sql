@@ -0,0 +1,3 @@
+-- last accepted TOTP time-step, codes of this or an older step are rejected as replays
+ALTER TABLE users
+    ADD totp_last_step BIGINT NULL;
@@ -0,0 +1,6 @@
+-- NOTE: google2_fa_secret keeps its width, sealed values are longer than the old 255 characters and narrowing
+-- would fail or truncate them. Re-encrypted rows stay sealed, decrypt them before dropping the versions.
+ALTER TABLE user_passkeys
+    DROP COLUMN key_version;
+ALTER TABLE users
+    DROP COLUMN secret_key_version;
@@ -0,0 +1,7 @@
+-- master key version that sealed the encrypted columns of a row, NULL while the value is still plaintext
+ALTER TABLE users
+    ADD secret_key_version INT NULL;
+ALTER TABLE users
+    ALTER COLUMN google2_fa_secret VARCHAR(512);
+ALTER TABLE user_passkeys
+    ADD key_version INT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE user_passkeys
+    DROP COLUMN nickname, last_used_at;
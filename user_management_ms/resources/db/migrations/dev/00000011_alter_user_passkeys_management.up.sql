@@ -0,0 +1,4 @@
+-- user given name and last successful assertion of a passkey
+ALTER TABLE user_passkeys
+    ADD nickname     NVARCHAR(100) NULL,
+        last_used_at DATETIME2     NULL;
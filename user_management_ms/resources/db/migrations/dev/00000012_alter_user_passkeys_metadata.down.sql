@@ -0,0 +1,2 @@
+ALTER TABLE user_passkeys
+    DROP COLUMN authenticator_name, certification_level;
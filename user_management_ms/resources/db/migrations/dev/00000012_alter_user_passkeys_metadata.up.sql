@@ -0,0 +1,4 @@
+-- authenticator model name and FIDO certification status from the metadata service at registration
+ALTER TABLE user_passkeys
+    ADD authenticator_name  NVARCHAR(255) NULL,
+        certification_level VARCHAR(50)   NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE user_passkeys
+    DROP COLUMN flagged_at, flag_reason;
@@ -0,0 +1,4 @@
+-- set when a login with the passkey showed an anomaly (sign count regression, backup state change, no user verification)
+ALTER TABLE user_passkeys
+    ADD flagged_at  DATETIME2    NULL,
+        flag_reason VARCHAR(255) NULL;
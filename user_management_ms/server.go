@@ -1,10 +1,12 @@
 package main
 
 import (
+	"strings"
 	"time"
 	"user_management_ms/config"
 	"user_management_ms/controller"
 	"user_management_ms/middleware"
+	"user_management_ms/services"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -15,6 +17,11 @@ type Server struct {
 	AuthController       controller.IAuthController
 	GoogleAuthController controller.IGoogleAuthController
 	WebAuthnController   controller.IPasskeyController
+	JWKSController       controller.IJWKSController
+	SessionController    controller.ISessionController
+	AdminController      controller.IAdminController
+	TokenService         services.ITokenService
+	RedisService         services.IRedisService
 	Logger               *zap.Logger
 }
 
@@ -23,12 +30,22 @@ func NewServer(
 	AuthController controller.IAuthController,
 	GoogleAuthController controller.IGoogleAuthController,
 	WebAuthnController controller.IPasskeyController,
+	JWKSController controller.IJWKSController,
+	SessionController controller.ISessionController,
+	AdminController controller.IAdminController,
+	TokenService services.ITokenService,
+	RedisService services.IRedisService,
 	Logger *zap.Logger,
 ) *Server {
 	return &Server{
 		AuthController:       AuthController,
 		GoogleAuthController: GoogleAuthController,
 		WebAuthnController:   WebAuthnController,
+		JWKSController:       JWKSController,
+		SessionController:    SessionController,
+		AdminController:      AdminController,
+		TokenService:         TokenService,
+		RedisService:         RedisService,
 		Logger:               Logger,
 	}
 }
@@ -38,47 +55,89 @@ func (s *Server) Start() *fiber.App {
 	// NOTE: Initialize Fiber Server
 	app := fiber.New()
 
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "http://localhost:5500",
-		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
-	}))
+	// NOTE: An empty allow list means "*" to the cors middleware, without web origins no CORS headers are sent
+	if origins := config.WebOrigins(); len(origins) > 0 {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins: strings.Join(origins, ","),
+			AllowMethods: "GET,POST,PUT,PATCH,DELETE,OPTIONS",
+			AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-Device-Name, X-WebAuthn-Client, X-QR-Secret",
+		}))
+	}
+
+	app.Use(middleware.GlobalRateLimiter(s.RedisService))
 
-	app.Use(middleware.GlobalRateLimiter())
+	// NOTE: Public verification keys for services validating our tokens
+	app.Get("/.well-known/jwks.json", s.JWKSController.JWKS)
+	app.Get("/.well-known/webauthn", s.WebAuthnController.RelatedOrigins)
 
 	// NOTE: Define API paths (context path and grouping by version)
 	contextPath := app.Group(config.Conf.Application.Server.ContextPath)
 	apiVersion := contextPath.Group(config.Conf.Application.Server.ApiVersion)
 
+	// NOTE: Sensitive account changes need a recent login or step-up on top of a valid token
+	stepUp := middleware.RequireACR(services.ACRLogin, time.Duration(config.Conf.Application.Security.StepUp.MaxAgeInSeconds)*time.Second)
+
 	//s.configureAuthGroup(apiVersion)
 	authGroup := apiVersion.Group("/auth")
 	authGroup.Use(middleware.LoggingMiddleware(s.Logger))
-	authGroup.Post("/request-otp", middleware.RouteRateLimiter(10, 10*time.Minute), s.AuthController.RegisterRequestOTP)
-	authGroup.Post("/verify-otp", s.AuthController.VerifyRegisterOTP)
-	authGroup.Post("/resend-otp", s.AuthController.ResendOTP)
+	authGroup.Post("/request-otp", middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.RegisterRequestOTP)
+	authGroup.Post("/verify-otp", middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.VerifyRegisterOTP)
+	authGroup.Post("/resend-otp", middleware.RouteRateLimiter(s.RedisService, 5, 10*time.Minute), s.AuthController.ResendOTP)
 	authGroup.Post("/complete-registration", s.AuthController.CompleteRegistration)
-	authGroup.Post("/login", s.AuthController.LoginLocal)
-	authGroup.Post("/verify-login-otp", s.AuthController.VerifyLoginOTP)
+	authGroup.Post("/login", middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.LoginLocal)
+	authGroup.Post("/verify-login-otp", middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.VerifyLoginOTP)
+	authGroup.Post("/mfa/verify", middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.VerifyLoginMFA)
+	authGroup.Post("/mfa/otp", middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.VerifyLoginMFAOTP)
+	authGroup.Post("/mfa/recovery", middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.VerifyLoginRecovery)
 	authGroup.Post("/refresh-token", s.AuthController.RefreshToken)
-	authGroup.Get("/setup-2fa", s.AuthController.Setup2FA)
-	authGroup.Post("/verify-2fa", s.AuthController.Verify2FA)
-	authGroup.Post("/pin/set", s.AuthController.SetPIN)
-	authGroup.Post("/pin/verify", s.AuthController.VerifyPIN)
-	authGroup.Post("/qr", s.AuthController.QrLoginRequest)
-	authGroup.Post("/qr/approve", middleware.AuthMiddleware(), s.AuthController.ApproveLoginRequest)
+	authGroup.Post("/logout", middleware.AuthMiddleware(s.TokenService), s.AuthController.Logout)
+	authGroup.Post("/logout-all", middleware.AuthMiddleware(s.TokenService), s.AuthController.LogoutAll)
+	authGroup.Get("/sessions", middleware.AuthMiddleware(s.TokenService), s.SessionController.ListSessions)
+	authGroup.Delete("/sessions/:sessionId", middleware.AuthMiddleware(s.TokenService), s.SessionController.RevokeSession)
+	authGroup.Get("/setup-2fa", middleware.AuthMiddleware(s.TokenService), stepUp, s.AuthController.Setup2FA)
+	authGroup.Post("/verify-2fa", middleware.AuthMiddleware(s.TokenService), stepUp, s.AuthController.Verify2FA)
+	authGroup.Post("/2fa/recovery-codes", middleware.AuthMiddleware(s.TokenService), s.AuthController.RegenerateRecoveryCodes)
+	authGroup.Post("/2fa/disable", middleware.AuthMiddleware(s.TokenService), s.AuthController.Disable2FA)
+	authGroup.Post("/2fa/re-enroll", middleware.AuthMiddleware(s.TokenService), s.AuthController.Reenroll2FA)
+	authGroup.Post("/2fa/re-enroll/confirm", middleware.AuthMiddleware(s.TokenService), s.AuthController.ConfirmReenroll2FA)
+	authGroup.Post("/pin/set", middleware.AuthMiddleware(s.TokenService), stepUp, s.AuthController.SetPIN)
+	authGroup.Post("/pin/verify", middleware.AuthMiddleware(s.TokenService), s.AuthController.VerifyPIN)
+	authGroup.Post("/pin/change", middleware.AuthMiddleware(s.TokenService), s.AuthController.ChangePIN)
+	authGroup.Post("/pin/reset", middleware.AuthMiddleware(s.TokenService), middleware.RouteRateLimiter(s.RedisService, 5, 10*time.Minute), s.AuthController.RequestPINReset)
+	authGroup.Post("/pin/reset/confirm", middleware.AuthMiddleware(s.TokenService), middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.ResetPIN)
+	authGroup.Post("/step-up", middleware.AuthMiddleware(s.TokenService), middleware.RouteRateLimiter(s.RedisService, 10, 10*time.Minute), s.AuthController.StepUp)
+	authGroup.Post("/step-up/passkey/start", middleware.AuthMiddleware(s.TokenService), s.WebAuthnController.StepUpStart)
+	authGroup.Post("/step-up/passkey/finish/:sessionId", middleware.AuthMiddleware(s.TokenService), s.WebAuthnController.StepUpFinish)
+	authGroup.Post("/transactions/passkey/start", middleware.AuthMiddleware(s.TokenService), middleware.RouteRateLimiter(s.RedisService, 20, 10*time.Minute), s.WebAuthnController.TransactionStart)
+	authGroup.Post("/transactions/:transactionId/confirm", middleware.AuthMiddleware(s.TokenService), s.WebAuthnController.TransactionFinish)
+	authGroup.Post("/qr", middleware.RouteRateLimiter(s.RedisService, 20, 10*time.Minute), s.AuthController.QrLoginRequest)
+	authGroup.Post("/qr/scan", middleware.AuthMiddleware(s.TokenService), s.AuthController.ScanLoginRequest)
+	authGroup.Post("/qr/approve", middleware.AuthMiddleware(s.TokenService), s.AuthController.ApproveLoginRequest)
+	authGroup.Post("/qr/reject", middleware.AuthMiddleware(s.TokenService), s.AuthController.RejectLoginRequest)
+	authGroup.Post("/qr/:sessionId/cancel", s.AuthController.CancelLoginRequest)
 	authGroup.Post("/qr/:sessionId/status", s.AuthController.CheckLoginRequest)
+	authGroup.Get("/qr/:sessionId/events", s.AuthController.LoginRequestEvents)
 
 	authGroup.Get("/google/call-back", s.GoogleAuthController.GoogleCallback)
 	authGroup.Get("/google/login", s.GoogleAuthController.GoogleLogin)
-	authGroup.Post("/google/request-otp", s.GoogleAuthController.GoogleRequestPhoneOTP)
+	authGroup.Post("/google/request-otp", middleware.RouteRateLimiter(s.RedisService, 5, 10*time.Minute), s.GoogleAuthController.GoogleRequestPhoneOTP)
 	authGroup.Post("/google/verify-otp/:email", s.GoogleAuthController.GoogleVerifyRequestOTP)
 	authGroup.Post("/google/complete-registration", s.GoogleAuthController.CompleteGoogleRegistration)
 	authGroup.Post("/google/login/verify-otp", s.GoogleAuthController.GoogleVerifyLoginRequestOtp)
 
-	authGroup.Post("/register/start", middleware.AuthMiddleware(), s.WebAuthnController.RegisterStart)
-	authGroup.Post("/register/finish", middleware.AuthMiddleware(), s.WebAuthnController.RegisterFinish)
-	authGroup.Post("/login/start", s.WebAuthnController.LoginStart)
+	authGroup.Post("/register/start", middleware.AuthMiddleware(s.TokenService), s.WebAuthnController.RegisterStart)
+	authGroup.Post("/register/finish", middleware.AuthMiddleware(s.TokenService), s.WebAuthnController.RegisterFinish)
+	// NOTE: Keyed by IP and route only, an email in the key would give every probed address a fresh bucket
+	authGroup.Post("/login/start", middleware.RouteRateLimiter(s.RedisService, 20, 10*time.Minute, middleware.KeyByIP, middleware.KeyByRoute), s.WebAuthnController.LoginStart)
 	authGroup.Post("/login/finish/:sessionId", s.WebAuthnController.LoginFinish)
+	authGroup.Get("/passkeys", middleware.AuthMiddleware(s.TokenService), s.WebAuthnController.ListPasskeys)
+	authGroup.Patch("/passkeys/:passkeyId", middleware.AuthMiddleware(s.TokenService), s.WebAuthnController.RenamePasskey)
+	authGroup.Delete("/passkeys/:passkeyId", middleware.AuthMiddleware(s.TokenService), stepUp, s.WebAuthnController.DeletePasskey)
+
+	// NOTE: Internal operations for support staff
+	adminGroup := apiVersion.Group("/admin", middleware.LoggingMiddleware(s.Logger), middleware.AdminKeyMiddleware(config.Conf.Application.Admin.ApiKey))
+	adminGroup.Post("/users/:userId/unlock", s.AdminController.UnlockUser)
+	adminGroup.Post("/encryption/reencrypt", s.AdminController.ReencryptSecrets)
 	return app
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"user_management_ms/repository"
 	"user_management_ms/services"
+	"user_management_ms/util"
 
 	"os"
 	"os/signal"
@@ -12,7 +13,6 @@ import (
 	"user_management_ms/config"
 	"user_management_ms/controller"
 
-	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/redis/go-redis/v9"
@@ -35,7 +35,7 @@ type service struct {
 	oauthConfig *oauth2.Config
 
 	//WebAuthn Conf
-	webAuthn *webauthn.WebAuthn
+	webAuthn *config.RelyingParties
 
 	// Repository
 	userRepository   repository.IUserRepository
@@ -44,14 +44,23 @@ type service struct {
 	// Service
 	userService    services.IUserService
 	jwtService     services.IJWTService
+	tokenService   services.ITokenService
+	otpService     services.IOTPService
+	lockoutService services.ILockoutService
 	googleService  services.IGoogleAuthService
 	redisService   services.IRedisService
 	passkeyService services.IPasskeyService
 
+	// Background jobs
+	secretReencryptor *services.SecretReencryptor
+
 	// Controller
 	authController       controller.IAuthController
 	googleAuthController controller.IGoogleAuthController
 	passkeyController    controller.IPasskeyController
+	jwksController       controller.IJWKSController
+	sessionController    controller.ISessionController
+	adminController      controller.IAdminController
 }
 
 // NOTE: Service Start
@@ -77,7 +86,7 @@ func (s *service) Start() {
 	//TODO: coment and log
 
 	// NOTE: Start Fiber server...
-	app := NewServer(s.authController, s.googleAuthController, s.passkeyController, s.logger).Start()
+	app := NewServer(s.authController, s.googleAuthController, s.passkeyController, s.jwksController, s.sessionController, s.adminController, s.tokenService, s.redisService, s.logger).Start()
 
 	log.Info("Server starting..")
 	// NOTE: Server start with goroutine
@@ -92,25 +101,53 @@ func (s *service) Start() {
 
 // NOTE: Depency Injection Operation
 func (s *service) DependencyInjection() {
-	// NOTE: JWT services configured and initialize...
-	s.jwtService = &services.JWTService{
-		Secret:     []byte(config.Conf.Application.Security.Secret),
-		Issuer:     config.Conf.Application.Security.Issuer,
-		AccessTTL:  time.Duration(config.Conf.Application.Security.TokenValidityInSeconds) * time.Second,
-		RefreshTTL: time.Duration(config.Conf.Application.Security.TokenValidityInSecondsForRememberMe) * time.Second,
+	// NOTE: Signing keys loaded and JWT services configured...
+	refreshTTL := time.Duration(config.Conf.Application.Security.TokenValidityInSecondsForRememberMe) * time.Second
+	signing := config.Conf.Application.Security.Signing
+	keyRing, err := services.NewKeyRing(signing.Algorithm, signing.KeyFiles, refreshTTL, signing.AllowEphemeralKeys)
+	if err != nil {
+		log.Panic("Failed to initialize signing keys: ", err)
+	}
+	keyRing.StartRotation(time.Duration(signing.RotationIntervalInSeconds) * time.Second)
+	s.jwtService = services.NewJWTService(
+		keyRing,
+		config.Conf.Application.Security.Issuer,
+		time.Duration(config.Conf.Application.Security.TokenValidityInSeconds)*time.Second,
+		refreshTTL,
+	)
+	// NOTE: Master keys for the envelope encrypted columns, the repositories seal and open them transparently
+	encryption := config.Conf.Application.Security.Encryption
+	envelope, err := util.LoadEnvelope(encryption.CurrentKeyVersion, encryption.MasterKeys, encryption.MasterKeyFile)
+	if err != nil {
+		log.Panic("Failed to initialize encryption keys: ", err)
+	}
+	if envelope == nil {
+		log.Warn("No encryption master key configured, sensitive columns are stored as plaintext")
+	} else {
+		util.SetEnvelope(envelope)
 	}
 	// NOTE: Repositories Injections
 	s.userRepository = repository.NewUserRepository()
 	s.googleRepository = repository.NewGoogleRepository()
 	// NOTE: Services Injections
 	s.redisService = services.NewRedisService(s.redisClient)
-	s.userService = services.NewUserService(s.dbConnection, s.userRepository, s.redisService, s.jwtService)
-	s.googleService = services.NewGoogleAuthService(s.dbConnection, s.oauthConfig, s.googleRepository, s.jwtService, s.redisService)
-	s.passkeyService = services.NewPasskeyService(s.webAuthn, s.dbConnection, s.userRepository, s.redisService, s.jwtService)
+	s.otpService = services.NewOTPService(s.redisService)
+	s.tokenService = services.NewTokenService(s.jwtService, s.redisService, s.otpService, time.Duration(config.Conf.Application.Security.StepUp.TokenValidityInSeconds)*time.Second)
+	s.lockoutService = services.NewLockoutService(s.redisService)
+	s.secretReencryptor = services.NewSecretReencryptor(s.dbConnection, s.userRepository, s.redisService)
+	if envelope != nil {
+		s.secretReencryptor.Start(time.Duration(encryption.ReencryptIntervalInSeconds) * time.Second)
+	}
+	s.userService = services.NewUserService(s.dbConnection, s.userRepository, s.redisService, s.jwtService, s.tokenService, s.otpService, s.lockoutService)
+	s.googleService = services.NewGoogleAuthService(s.dbConnection, s.oauthConfig, s.googleRepository, s.jwtService, s.redisService, s.tokenService, s.otpService)
+	s.passkeyService = services.NewPasskeyService(s.webAuthn, s.dbConnection, s.userRepository, s.redisService, s.jwtService, s.tokenService)
 	// NOTE: Controllers Injections
 	s.authController = controller.NewAuthController(s.userService)
 	s.googleAuthController = controller.NewGoogleAuthController(s.googleService)
 	s.passkeyController = controller.NewPasskeyController(s.passkeyService)
+	s.jwksController = controller.NewJWKSController(s.jwtService)
+	s.sessionController = controller.NewSessionController(s.tokenService)
+	s.adminController = controller.NewAdminController(s.lockoutService, s.secretReencryptor)
 
 }
 
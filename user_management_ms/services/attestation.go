@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"user_management_ms/config"
+	"user_management_ms/util"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	ErrAuthenticatorNotAllowed = errors.New("this authenticator model is not allowed")
+	ErrAttestationRequired     = errors.New("authenticator attestation is required")
+)
+
+// checkAuthenticatorPolicy applies the AAGUID allow and deny lists to a newly registered credential. The
+// signature and metadata checks of the attestation already ran in FinishRegistration, but a "none"
+// attestation skips them, so it is refused while metadata is required.
+func checkAuthenticatorPolicy(cred *webauthn.Credential) error {
+	policy := config.Conf.Application.WebAuthn.Attestation
+	if policy.RequireMetadata && cred.AttestationType == string(protocol.AttestationFormatNone) {
+		return ErrAttestationRequired
+	}
+
+	aaguid := util.FormatAAGUID(cred.Authenticator.AAGUID)
+	matches := func(entry string) bool { return strings.EqualFold(strings.TrimSpace(entry), aaguid) }
+	if slices.ContainsFunc(policy.DeniedAaguids, matches) {
+		return ErrAuthenticatorNotAllowed
+	}
+	if len(policy.AllowedAaguids) > 0 && !slices.ContainsFunc(policy.AllowedAaguids, matches) {
+		return ErrAuthenticatorNotAllowed
+	}
+	return nil
+}
+
+// authenticatorMetadata looks up the model name and FIDO certification level of the authenticator,
+// both are empty when no metadata is loaded or the model is not listed
+func authenticatorMetadata(mds metadata.Provider, aaguid []byte) (string, string) {
+	if mds == nil || util.FormatAAGUID(aaguid) == "" {
+		return "", ""
+	}
+	var id [16]byte
+	copy(id[:], aaguid)
+	// NOTE: An all zero AAGUID means the authenticator does not disclose its model
+	if id == [16]byte{} {
+		return "", ""
+	}
+	entry, err := mds.GetEntry(context.Background(), id)
+	if err != nil || entry == nil {
+		return "", ""
+	}
+	return entry.MetadataStatement.Description, certificationLevel(entry.StatusReports)
+}
+
+// certificationLevel returns the most recent certification status of the status reports
+func certificationLevel(reports []metadata.StatusReport) string {
+	var latest *metadata.StatusReport
+	for i, report := range reports {
+		if !strings.HasPrefix(string(report.Status), string(metadata.FidoCertified)) && report.Status != metadata.NotFidoCertified {
+			continue
+		}
+		if latest == nil || !report.EffectiveDate.Before(latest.EffectiveDate) {
+			latest = &reports[i]
+		}
+	}
+	if latest == nil {
+		return ""
+	}
+	return string(latest.Status)
+}
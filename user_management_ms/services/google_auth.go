@@ -2,7 +2,9 @@ package services
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
 	"log"
 	"time"
@@ -11,7 +13,6 @@ import (
 	"user_management_ms/dtos/request"
 	"user_management_ms/dtos/response"
 	"user_management_ms/repository"
-	"user_management_ms/util"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
@@ -20,80 +21,132 @@ import (
 )
 
 type IGoogleAuthService interface {
-	LoginGoogle(state string) string
-	ExchangeGoogleToken(code string) (*oauth2.Token, error)
-	GetUserInfo(code string) (*response.GoogleUser, error)
-	VerifyGoogleIDToken(idToken string) (*response.GoogleUser, error)
+	LoginGoogle() (string, string, error)
+	CompleteGoogleLogin(state, code string) (*response.GoogleUser, error)
+	ExchangeGoogleToken(code, verifier string) (*oauth2.Token, error)
+	VerifyGoogleIDToken(idToken, nonce string) (*response.GoogleUser, error)
 	FindUserByGoogleID(id string) (*domain.User, error)
-	StartGoogleRegistration(req *request.StartGoogleRegistration) (*response.GoogleResponse, error)
+	StartGoogleRegistration(req *request.StartGoogleRegistration, client *request.ClientInfo) (*response.GoogleResponse, error)
 	VerifyPhoneOTP(req *request.VerifyNumberOTPRequest) (*response.OTPResponsePhone, error)
-	CompleteGoogleRegistration(req *request.CompleteGoogleRegistration) (*response.Tokens, error)
-	SendEmailLoginOtp(req *request.OTPRequestEmail) (*response.OTPResponseEmail, error)
-	VerifyGoogleLoginOtp(req *request.VerifyEmailOTPRequest) (*response.Tokens, error)
+	CompleteGoogleRegistration(req *request.CompleteGoogleRegistration, client *request.ClientInfo) (*response.Tokens, error)
+	SendEmailLoginOtp(req *request.OTPRequestEmail, client *request.ClientInfo) (*response.OTPResponseEmail, error)
+	VerifyGoogleLoginOtp(req *request.VerifyEmailOTPRequest, client *request.ClientInfo) (*response.Tokens, error)
 	CreteNewGoogleUser(email, googleId string) (*domain.User, bool, error)
-	SendPhoneVerificationOtp(req *request.OTPRequestPhone) (*response.OTPResponsePhone, error)
+	SendPhoneVerificationOtp(req *request.OTPRequestPhone, client *request.ClientInfo) (*response.OTPResponsePhone, error)
 }
 
+// oauthAttemptTTL is how long the user has to finish the Google consent screen
+const oauthAttemptTTL = 10 * time.Minute
+
+var (
+	ErrOAuthState = errors.New("invalid or expired oauth state")
+	ErrOAuthNonce = errors.New("id token nonce does not match the login attempt")
+)
+
 type GoogleAuthService struct {
 	db         *gorm.DB
 	oauthConf  *oauth2.Config
 	jwt        IJWTService
 	googleRepo repository.IGoogleRepository
 	redis      IRedisService
+	tokens     ITokenService
+	otp        IOTPService
 }
 
-func NewGoogleAuthService(db *gorm.DB, oauthConf *oauth2.Config, googleRepo repository.IGoogleRepository, jwtService IJWTService, rdb IRedisService) IGoogleAuthService {
-	return &GoogleAuthService{googleRepo: googleRepo, oauthConf: oauthConf, jwt: jwtService, db: db, redis: rdb}
-}
-func (g *GoogleAuthService) LoginGoogle(state string) string {
-	url := g.oauthConf.AuthCodeURL(state)
-	return url
+func NewGoogleAuthService(db *gorm.DB, oauthConf *oauth2.Config, googleRepo repository.IGoogleRepository, jwtService IJWTService, rdb IRedisService, tokens ITokenService, otp IOTPService) IGoogleAuthService {
+	return &GoogleAuthService{googleRepo: googleRepo, oauthConf: oauthConf, jwt: jwtService, db: db, redis: rdb, tokens: tokens, otp: otp}
 }
 
-func (g *GoogleAuthService) ExchangeGoogleToken(code string) (*oauth2.Token, error) {
-	token, err := g.oauthConf.Exchange(context.Background(), code)
+// LoginGoogle starts a login attempt, its state, PKCE verifier and OIDC nonce are kept until the callback
+func (g *GoogleAuthService) LoginGoogle() (string, string, error) {
+	state, err := randomToken()
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
-	return token, err
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	attempt := &OAuthAttempt{
+		State:     state,
+		Verifier:  oauth2.GenerateVerifier(),
+		Nonce:     nonce,
+		CreatedAt: time.Now(),
+	}
+	if err := g.redis.StoreOAuthAttempt(attempt, oauthAttemptTTL); err != nil {
+		return "", "", err
+	}
+	url := g.oauthConf.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(attempt.Verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	)
+	return url, state, nil
 }
 
-func (g *GoogleAuthService) GetUserInfo(code string) (*response.GoogleUser, error) {
-
-	token, err := g.ExchangeGoogleToken(code)
+// CompleteGoogleLogin checks the callback against the stored attempt, redeems the code with the PKCE
+// verifier and returns the user from the verified ID token
+func (g *GoogleAuthService) CompleteGoogleLogin(state, code string) (*response.GoogleUser, error) {
+	if state == "" {
+		return nil, ErrOAuthState
+	}
+	attempt, err := g.redis.ConsumeOAuthAttempt(state)
 	if err != nil {
-		return nil, err
+		return nil, ErrOAuthState
 	}
-
-	client := g.oauthConf.Client(context.Background(), token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
+	token, err := g.ExchangeGoogleToken(code, attempt.Verifier)
 	if err != nil {
-		return nil, errors.New("failed to get user info")
+		return nil, err
 	}
-	defer resp.Body.Close()
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("id_token is required")
+	}
+	return g.VerifyGoogleIDToken(idToken, attempt.Nonce)
+}
 
-	var gUser response.GoogleUser
-	if err := json.NewDecoder(resp.Body).Decode(&gUser); err != nil {
-		return nil, errors.New("failed to decode user info")
+func (g *GoogleAuthService) ExchangeGoogleToken(code, verifier string) (*oauth2.Token, error) {
+	token, err := g.oauthConf.Exchange(context.Background(), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
 	}
-	return &gUser, nil
+	return token, err
 }
 
-func (g *GoogleAuthService) VerifyGoogleIDToken(idToken string) (*response.GoogleUser, error) {
+// VerifyGoogleIDToken validates the ID token and that it was issued for our login attempt via its nonce
+func (g *GoogleAuthService) VerifyGoogleIDToken(idToken, nonce string) (*response.GoogleUser, error) {
 	payload, err := idtoken.Validate(context.Background(), idToken, config.Conf.Application.OAuth2.ClientID)
 	if err != nil {
 		return nil, err
 	}
+	tokenNonce, _ := payload.Claims["nonce"].(string)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, ErrOAuthNonce
+	}
+	sub, _ := payload.Claims["sub"].(string)
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if sub == "" || email == "" {
+		return nil, errors.New("id token has no subject or email")
+	}
 	user := &response.GoogleUser{
-		ID:            payload.Claims["sub"].(string),
-		Email:         payload.Claims["email"].(string),
-		VerifiedEmail: payload.Claims["email_verified"].(bool),
+		ID:            sub,
+		Email:         email,
+		VerifiedEmail: verified,
 	}
 
 	return user, nil
 }
 
-func (g *GoogleAuthService) StartGoogleRegistration(req *request.StartGoogleRegistration) (*response.GoogleResponse, error) {
+// randomToken returns 32 random bytes encoded for use in URLs
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (g *GoogleAuthService) StartGoogleRegistration(req *request.StartGoogleRegistration, client *request.ClientInfo) (*response.GoogleResponse, error) {
 	// validate input quickly (optional but helpful)
 	if req.Email == "" {
 		return nil, errors.New("email is required")
@@ -140,20 +193,14 @@ func (g *GoogleAuthService) StartGoogleRegistration(req *request.StartGoogleRegi
 				return nil, errors.New("user with this phone already exists")
 			}
 
-			// attach phone and create phone OTP
-			otp := util.GenerateOTP()
-			expire := time.Now().Add(5 * time.Minute)
-
-			updatedUser, err := g.googleRepo.UpdateGoogleUserPhone(g.db, req.Email, req.Phone, otp, expire)
+			// attach phone and create phone OTP challenge
+			updatedUser, err := g.googleRepo.UpdateGoogleUserPhone(g.db, req.Email, req.Phone)
 			if err != nil {
 				return nil, err
 			}
-
-			// send OTP via kafka
-			if err := SendVerifyPhoneNumberEventToKafka(&request.VerifyPhoneEvent{
-				Phone:    updatedUser.Phone,
-				PhoneOTP: otp,
-			}); err != nil {
+			// send OTP via kafka, throttled like every other send
+			challengeId, resendAfter, err := g.otp.SendChallenge(OTPPurposeGooglePhoneLink, updatedUser.Id, map[string]string{OTPChannelPhone: updatedUser.Phone}, client)
+			if err != nil {
 				return nil, err
 			}
 
@@ -162,6 +209,8 @@ func (g *GoogleAuthService) StartGoogleRegistration(req *request.StartGoogleRegi
 				Phone:         updatedUser.Phone,
 				Status:        "phone_verification_pending",
 				PhoneVerified: updatedUser.PhoneVerified,
+				ChallengeId:   challengeId,
+				ResendAfter:   resendAfter,
 			}, nil
 		}
 
@@ -200,12 +249,14 @@ func (g *GoogleAuthService) VerifyPhoneOTP(req *request.VerifyNumberOTPRequest)
 	if err != nil {
 		return nil, err
 	}
-	if user.PhoneOtp != req.PhoneOTP || time.Now().After(*user.PhoneOtpExpireDate) {
-		return nil, errors.New("invalid or expired OTP")
+	challenge, err := g.otp.VerifyChallenge(req.ChallengeId, OTPPurposeGooglePhoneLink, map[string]string{OTPChannelPhone: req.PhoneOTP})
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserId != user.Id {
+		return nil, ErrOTPInvalid
 	}
 	user.PhoneVerified = true
-	user.PhoneOtp = ""
-	user.PhoneOtpExpireDate = nil
 
 	if _, err := g.googleRepo.Update(g.db, user); err != nil {
 		return nil, err
@@ -218,7 +269,7 @@ func (g *GoogleAuthService) VerifyPhoneOTP(req *request.VerifyNumberOTPRequest)
 	}, nil
 }
 
-func (g *GoogleAuthService) CompleteGoogleRegistration(req *request.CompleteGoogleRegistration) (*response.Tokens, error) {
+func (g *GoogleAuthService) CompleteGoogleRegistration(req *request.CompleteGoogleRegistration, client *request.ClientInfo) (*response.Tokens, error) {
 	// 1. Check if user exists
 	user, err := g.googleRepo.FindUserByEmail(g.db, req.Email)
 	if err != nil {
@@ -251,7 +302,7 @@ func (g *GoogleAuthService) CompleteGoogleRegistration(req *request.CompleteGoog
 	}
 
 	// 5. Generate tokens
-	tokens, err := g.jwt.GenerateTokens(user)
+	tokens, err := g.tokens.IssueTokens(user, &SessionOptions{LoginMethod: LoginMethodGoogle, Client: client})
 	if err != nil {
 		return nil, err
 	}
@@ -262,29 +313,25 @@ func (g *GoogleAuthService) CompleteGoogleRegistration(req *request.CompleteGoog
 	}, nil
 }
 
-func (g *GoogleAuthService) SendEmailLoginOtp(req *request.OTPRequestEmail) (*response.OTPResponseEmail, error) {
+func (g *GoogleAuthService) SendEmailLoginOtp(req *request.OTPRequestEmail, client *request.ClientInfo) (*response.OTPResponseEmail, error) {
 	user, err := g.googleRepo.FindUserByEmail(g.db, req.Email)
 	if err != nil {
 		return nil, err
 	}
-	otp := util.GenerateOTP()
-	expire := time.Now().Add(5 * time.Minute)
-	user.EmailOtp = otp
-	user.EmailOtpExpireDate = &expire
-	if _, err := g.googleRepo.Update(g.db, user); err != nil {
-		return nil, err
-	}
-	if err := SendVerifyEmailEventToKafka(&request.VerifyEmailEvent{Email: req.Email, EmailOTP: otp}); err != nil {
+	challengeId, resendAfter, err := g.otp.SendChallenge(OTPPurposeGoogleLogin, user.Id, map[string]string{OTPChannelEmail: req.Email}, client)
+	if err != nil {
 		return nil, err
 	}
 	return &response.OTPResponseEmail{
-		Email:   req.Email,
-		Status:  "otp_sent",
-		Message: "Email OTP sent",
+		Email:       req.Email,
+		Status:      "otp_sent",
+		Message:     "Email OTP sent",
+		ChallengeId: challengeId,
+		ResendAfter: resendAfter,
 	}, nil
 }
 
-func (g *GoogleAuthService) VerifyGoogleLoginOtp(req *request.VerifyEmailOTPRequest) (*response.Tokens, error) {
+func (g *GoogleAuthService) VerifyGoogleLoginOtp(req *request.VerifyEmailOTPRequest, client *request.ClientInfo) (*response.Tokens, error) {
 	user, err := g.googleRepo.FindUserByEmail(g.db, req.Email)
 	if user != nil && (user.Password == "" || user.BirthDate == nil) {
 		return nil, errors.New("user hasn't completed registration")
@@ -292,22 +339,14 @@ func (g *GoogleAuthService) VerifyGoogleLoginOtp(req *request.VerifyEmailOTPRequ
 	if err != nil {
 		return nil, err
 	}
-	if user.EmailOtp != req.EmailOTP || time.Now().After(*user.EmailOtpExpireDate) {
-		return nil, errors.New("invalid or expired OTP")
-	}
-	user.EmailOtp = ""
-	user.EmailOtpExpireDate = nil
-	if _, err := g.googleRepo.Update(g.db, user); err != nil {
-		return nil, err
-	}
-	tokens, err := g.jwt.GenerateTokens(user)
+	challenge, err := g.otp.VerifyChallenge(req.ChallengeId, OTPPurposeGoogleLogin, map[string]string{OTPChannelEmail: req.EmailOTP})
 	if err != nil {
 		return nil, err
 	}
-	return &response.Tokens{
-		AccessToken:  tokens.AccessToken,
-		RefreshToken: tokens.RefreshToken,
-	}, nil
+	if challenge.UserId != user.Id {
+		return nil, ErrOTPInvalid
+	}
+	return g.tokens.StartLogin(user, &SessionOptions{LoginMethod: LoginMethodGoogle, Client: client})
 }
 
 // CreteNewGoogleUser return:User,new user created,error
@@ -336,24 +375,20 @@ func (g *GoogleAuthService) CreteNewGoogleUser(email, googleId string) (*domain.
 	return nil, false, err
 }
 
-func (g *GoogleAuthService) SendPhoneVerificationOtp(req *request.OTPRequestPhone) (*response.OTPResponsePhone, error) {
+func (g *GoogleAuthService) SendPhoneVerificationOtp(req *request.OTPRequestPhone, client *request.ClientInfo) (*response.OTPResponsePhone, error) {
 	user, err := g.googleRepo.FindUserByPhoneNumber(g.db, req.Phone)
 	if err != nil {
 		return nil, err
 	}
-	otp := util.GenerateOTP()
-	expire := time.Now().Add(5 * time.Minute)
-	user.PhoneOtp = otp
-	user.PhoneOtpExpireDate = &expire
-	if _, err := g.googleRepo.Update(g.db, user); err != nil {
-		return nil, err
-	}
-	if err := SendVerifyPhoneNumberEventToKafka(&request.VerifyPhoneEvent{Phone: req.Phone, PhoneOTP: otp}); err != nil {
+	challengeId, resendAfter, err := g.otp.SendChallenge(OTPPurposeGooglePhoneLink, user.Id, map[string]string{OTPChannelPhone: req.Phone}, client)
+	if err != nil {
 		return nil, err
 	}
 	return &response.OTPResponsePhone{
-		Phone:   req.Phone,
-		Status:  "otp_sent",
-		Message: "Email OTP sent",
+		Phone:       req.Phone,
+		Status:      "otp_sent",
+		Message:     "Email OTP sent",
+		ChallengeId: challengeId,
+		ResendAfter: resendAfter,
 	}, nil
 }
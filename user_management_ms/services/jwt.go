@@ -2,46 +2,87 @@ package services
 
 import (
 	"errors"
+	"strconv"
 	"time"
 	"user_management_ms/domain"
 	"user_management_ms/dtos/response"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/hashicorp/go-uuid"
 )
 
+const (
+	TokenUseAccess  = "access"
+	TokenUseRefresh = "refresh"
+	// TokenUseTransactionReceipt marks the signed approval of a transaction, it is never accepted as an access token
+	TokenUseTransactionReceipt = "tx_receipt"
+)
+
+// Authentication methods (RFC 8176 style) carried in the amr claim
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRTOTP     = "totp"
+	AMRPIN      = "pin"
+	AMRWebAuthn = "webauthn"
+	AMRGoogle   = "google"
+	AMRRecovery = "recovery"
+	AMRQR       = "qr"
+)
+
+// Authentication context levels carried in the acr claim, higher levels satisfy lower requirements
+const (
+	// ACRLogin is a regular session token
+	ACRLogin = 1
+	// ACRStepUp is a short-lived token minted after the user re-authenticated within the session
+	ACRStepUp = 2
+)
+
+// AuthContext describes when and how the user authenticated, it is embedded in access tokens
+type AuthContext struct {
+	AuthTime time.Time
+	AMR      []string
+	ACR      int
+}
+
 type IJWTService interface {
 	ParseJWT(tokenStr string) (*jwt.Token, error)
 	GetClaims(token *jwt.Token) (jwt.MapClaims, error)
-	GenerateToken(userID uint, duration time.Duration) (string, error)
-	GenerateTokens(user *domain.User) (*response.Tokens, error)
+	GenerateToken(userID uint, familyId string, auth *AuthContext, duration time.Duration) (string, error)
+	GenerateRefreshToken(userID uint, familyId, jti string) (string, error)
+	GenerateTokens(user *domain.User, familyId, refreshJti string, auth *AuthContext) (*response.Tokens, error)
+	GenerateTransactionReceipt(userID uint, transactionId, action, payloadHash string, duration time.Duration) (string, error)
+	JWKS() *response.JWKS
 }
 type JWTService struct {
-	Secret     []byte
+	Keys       *KeyRing
 	Issuer     string
 	AccessTTL  time.Duration
 	RefreshTTL time.Duration
 }
 
-func NewJWTService(secret []byte, issuer string, accessTtl time.Duration, refreshTtl time.Duration) *JWTService {
+func NewJWTService(keys *KeyRing, issuer string, accessTtl time.Duration, refreshTtl time.Duration) *JWTService {
 	return &JWTService{
-		Secret:     secret,
+		Keys:       keys,
 		Issuer:     issuer,
 		AccessTTL:  accessTtl,
 		RefreshTTL: refreshTtl,
 	}
 }
 
+// ParseJWT verifies the token signature with the key referenced by its kid header
 func (j *JWTService) ParseJWT(tokenStr string) (*jwt.Token, error) {
-	if len(j.Secret) == 0 {
-		return nil, errors.New("JWT secret is not configured")
+	if j.Keys == nil {
+		return nil, errors.New("JWT key ring is not configured")
 	}
 
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, errors.New("missing kid header")
 		}
-		return j.Secret, nil
-	})
+		return j.Keys.Lookup(kid)
+	}, jwt.WithValidMethods([]string{j.Keys.Method().Alg()}), jwt.WithIssuer(j.Issuer))
 
 	if err != nil {
 		return nil, err
@@ -60,24 +101,80 @@ func (j *JWTService) GetClaims(token *jwt.Token) (jwt.MapClaims, error) {
 	return claims, nil
 }
 
-func (j *JWTService) GenerateToken(userID uint, duration time.Duration) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": userID,
-		"iss": j.Issuer,
-		"exp": time.Now().Add(duration).Unix(),
+// GenerateToken creates an access token bound to the refresh token family of the session,
+// auth_time, amr and acr describe the authentication and stay the same across refreshes.
+// iat_ms carries the issue time in milliseconds for the logout-all cutoff.
+func (j *JWTService) GenerateToken(userID uint, familyId string, auth *AuthContext, duration time.Duration) (string, error) {
+	jti, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return j.sign(jwt.MapClaims{
+		"sub":       userID,
+		"iss":       j.Issuer,
+		"iat":       now.Unix(),
+		"iat_ms":    now.UnixMilli(),
+		"exp":       now.Add(duration).Unix(),
+		"jti":       jti,
+		"fid":       familyId,
+		"auth_time": auth.AuthTime.Unix(),
+		"amr":       auth.AMR,
+		"acr":       strconv.Itoa(auth.ACR),
+		"token_use": TokenUseAccess,
 	})
+}
 
-	return token.SignedString(j.Secret)
+// GenerateRefreshToken creates a refresh token belonging to the given token family
+func (j *JWTService) GenerateRefreshToken(userID uint, familyId, jti string) (string, error) {
+	return j.sign(jwt.MapClaims{
+		"sub":       userID,
+		"iss":       j.Issuer,
+		"iat":       time.Now().Unix(),
+		"exp":       time.Now().Add(j.RefreshTTL).Unix(),
+		"jti":       jti,
+		"fid":       familyId,
+		"token_use": TokenUseRefresh,
+	})
 }
 
-func (j *JWTService) GenerateTokens(user *domain.User) (*response.Tokens, error) {
-	accessToken, err := j.GenerateToken(user.Id, j.AccessTTL)
+func (j *JWTService) GenerateTokens(user *domain.User, familyId, refreshJti string, auth *AuthContext) (*response.Tokens, error) {
+	accessToken, err := j.GenerateToken(user.Id, familyId, auth, j.AccessTTL)
 	if err != nil {
 		return nil, err
 	}
-	refreshToken, err := j.GenerateToken(user.Id, j.RefreshTTL)
+	refreshToken, err := j.GenerateRefreshToken(user.Id, familyId, refreshJti)
 	if err != nil {
 		return nil, err
 	}
 	return &response.Tokens{AccessToken: accessToken, RefreshToken: refreshToken}, nil
 }
+
+// GenerateTransactionReceipt signs the passkey approval of a transaction. Services verify it with the JWKS and
+// check that payload_hash matches the operation they are about to execute.
+func (j *JWTService) GenerateTransactionReceipt(userID uint, transactionId, action, payloadHash string, duration time.Duration) (string, error) {
+	return j.sign(jwt.MapClaims{
+		"sub":          userID,
+		"iss":          j.Issuer,
+		"iat":          time.Now().Unix(),
+		"exp":          time.Now().Add(duration).Unix(),
+		"jti":          transactionId,
+		"token_use":    TokenUseTransactionReceipt,
+		"action":       action,
+		"payload_hash": payloadHash,
+		"amr":          []string{AMRWebAuthn},
+	})
+}
+
+func (j *JWTService) sign(claims jwt.MapClaims) (string, error) {
+	key := j.Keys.Current()
+	token := jwt.NewWithClaims(j.Keys.Method(), claims)
+	token.Header["kid"] = key.Kid
+
+	return token.SignedString(key.Signer)
+}
+
+// JWKS returns the public keys other services use to verify our tokens
+func (j *JWTService) JWKS() *response.JWKS {
+	return j.Keys.JWKS()
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"user_management_ms/dtos/request"
 
@@ -64,3 +65,39 @@ func SendVerifyEmailAndPhoneNumberEvent(verifyEmailEvent *request.VerifyEmailEve
 	}
 	return nil
 }
+
+// PublishSecurityEvent sends the event in the background for request paths that must not wait on Kafka,
+// a failure is only logged
+func PublishSecurityEvent(securityEvent *request.SecurityEvent) {
+	go func() {
+		if err := SendSecurityEventToKafka(securityEvent); err != nil {
+			log.Println("Failed to send security event:", err)
+		}
+	}()
+}
+
+func SendSecurityEventToKafka(securityEvent *request.SecurityEvent) error {
+	eventData, err := json.Marshal(securityEvent)
+	if err != nil {
+		return err
+	}
+
+	producer, err := sarama.NewSyncProducer([]string{"localhost:9092"}, nil)
+	if err != nil {
+		log.Println("Failed to create sync producer:", err)
+		return err
+	}
+	defer producer.Close()
+
+	eventMsg := &sarama.ProducerMessage{
+		Topic: "SecurityEvent",
+		Key:   sarama.StringEncoder(fmt.Sprintf("%d", securityEvent.UserId)),
+		Value: sarama.StringEncoder(eventData),
+	}
+
+	if _, _, err := producer.SendMessage(eventMsg); err != nil {
+		log.Println("Failed to send security event:", err)
+		return err
+	}
+	return nil
+}
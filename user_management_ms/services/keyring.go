@@ -0,0 +1,399 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"user_management_ms/dtos/response"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is a single entry of the key ring. Retired keys are no longer used for signing
+// but stay available for verification until the retention period passes.
+type SigningKey struct {
+	Kid       string
+	Signer    crypto.Signer
+	CreatedAt time.Time
+	RetiredAt *time.Time
+}
+
+// KeyRing holds the asymmetric keys used to sign and verify our JWTs
+type KeyRing struct {
+	mu        sync.RWMutex
+	method    jwt.SigningMethod
+	keys      map[string]*SigningKey
+	current   string
+	retention time.Duration
+	// keyFiles are the configured paths or glob patterns, empty for a ring of generated keys
+	keyFiles []string
+}
+
+// NewKeyRing loads the configured PEM key files, the last one becomes the signing key and the rest count
+// as retired: they verify tokens until the retention period passes, measured from when the key file after
+// them was written. Without key files a key is generated in memory, but only when allowEphemeral is set:
+// such a key dies with the process and is not shared with other replicas.
+func NewKeyRing(algorithm string, keyFiles []string, retention time.Duration, allowEphemeral bool) (*KeyRing, error) {
+	method, err := signingMethod(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	ring := &KeyRing{
+		method:    method,
+		keys:      make(map[string]*SigningKey),
+		retention: retention,
+	}
+	for _, file := range keyFiles {
+		if strings.TrimSpace(file) != "" {
+			ring.keyFiles = append(ring.keyFiles, file)
+		}
+	}
+
+	if len(ring.keyFiles) > 0 {
+		loaded, err := ring.loadKeyFiles()
+		if err != nil {
+			return nil, err
+		}
+		if len(loaded) == 0 {
+			return nil, errors.New("no signing key file matches security.signing.key-files")
+		}
+		now := time.Now()
+		// NOTE: The last key is never retired, so it is added last and becomes the signing key
+		for _, key := range loaded {
+			if !ring.expired(key, now) {
+				ring.add(key)
+			}
+		}
+		return ring, nil
+	}
+
+	if !allowEphemeral {
+		return nil, errors.New("no signing key files configured, set security.signing.key-files or allow-ephemeral-keys for local development")
+	}
+	log.Println("No signing key files configured, generating an in-memory signing key")
+	if err := ring.Rotate(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// loadKeyFiles reads the key files in configured order, patterns expand to their matches sorted by name.
+// Every key but the last is retired at the modification time of the key file that follows it.
+func (k *KeyRing) loadKeyFiles() ([]*SigningKey, error) {
+	var paths []string
+	for _, pattern := range k.keyFiles {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key pattern %s: %w", pattern, err)
+		}
+		if matches == nil {
+			// NOTE: A plain path that does not exist is reported by the load below
+			matches = []string{pattern}
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+
+	loaded := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signing key %s: %w", path, err)
+		}
+		signer, err := loadPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signing key %s: %w", path, err)
+		}
+		if err := checkKeyType(k.method, signer); err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", path, err)
+		}
+		kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		loaded = append(loaded, &SigningKey{Kid: kid, Signer: signer, CreatedAt: info.ModTime()})
+	}
+	for i := 0; i < len(loaded)-1; i++ {
+		retiredAt := loaded[i+1].CreatedAt
+		loaded[i].RetiredAt = &retiredAt
+	}
+	return loaded, nil
+}
+
+// Reload picks up changes of the shared key files. A new last key file is only published for verification
+// at first and signs from the next reload on, so every replica knows it before tokens signed with it arrive.
+// Keys whose file was removed stop verifying, except the one still signing.
+func (k *KeyRing) Reload() error {
+	loaded, err := k.loadKeyFiles()
+	if err != nil {
+		return err
+	}
+	if len(loaded) == 0 {
+		return errors.New("no signing key file matches security.signing.key-files")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	keys := make(map[string]*SigningKey, len(loaded)+1)
+	for _, key := range loaded {
+		if known, ok := k.keys[key.Kid]; ok {
+			// NOTE: Keep the retirement this ring already recorded, a later file write must not extend it
+			if known.RetiredAt != nil {
+				key.RetiredAt = known.RetiredAt
+			} else if key.Kid == k.current {
+				key.RetiredAt = nil
+			}
+		}
+		keys[key.Kid] = key
+	}
+
+	newest := loaded[len(loaded)-1]
+	if _, known := k.keys[newest.Kid]; known && newest.Kid != k.current {
+		if previous, ok := keys[k.current]; ok && previous.RetiredAt == nil {
+			previous.RetiredAt = &now
+		}
+		newest.RetiredAt = nil
+		k.current = newest.Kid
+		log.Printf("Signing key rotated, new kid: %s", newest.Kid)
+	} else if !known {
+		newest.RetiredAt = nil
+		log.Printf("Signing key %s published, it signs from the next rotation", newest.Kid)
+	}
+	if _, ok := keys[k.current]; !ok {
+		keys[k.current] = k.keys[k.current]
+	}
+
+	for id, key := range keys {
+		if id != k.current && k.expired(key, now) {
+			delete(keys, id)
+		}
+	}
+	k.keys = keys
+	return nil
+}
+
+// Method returns the JWT signing method used by the ring
+func (k *KeyRing) Method() jwt.SigningMethod {
+	return k.method
+}
+
+// Current returns the key new tokens are signed with
+func (k *KeyRing) Current() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[k.current]
+}
+
+// Lookup returns the public key for kid if it is still accepted for verification
+func (k *KeyRing) Lookup(kid string) (crypto.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok || k.expired(key, time.Now()) {
+		return nil, errors.New("unknown signing key")
+	}
+	return key.Signer.Public(), nil
+}
+
+// Rotate generates a new signing key and retires the current one
+func (k *KeyRing) Rotate() error {
+	signer, err := generateKey(k.method)
+	if err != nil {
+		return err
+	}
+	kid, err := thumbprint(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if previous, ok := k.keys[k.current]; ok {
+		previous.RetiredAt = &now
+	}
+	k.add(&SigningKey{Kid: kid, Signer: signer, CreatedAt: now})
+	for id, key := range k.keys {
+		if k.expired(key, now) {
+			delete(k.keys, id)
+		}
+	}
+	log.Printf("Signing key rotated, new kid: %s", kid)
+	return nil
+}
+
+// StartRotation rotates the signing key in the background on every interval. A ring loaded from key files
+// reloads them, so replacing the shared files rotates every replica. Otherwise a new key is generated.
+func (k *KeyRing) StartRotation(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	rotate := k.Rotate
+	if len(k.keyFiles) > 0 {
+		rotate = k.Reload
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := rotate(); err != nil {
+				log.Println("Failed to rotate signing key:", err)
+			}
+		}
+	}()
+}
+
+// JWKS returns every verification key in JSON Web Key Set format
+func (k *KeyRing) JWKS() *response.JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	set := &response.JWKS{Keys: []response.JWK{}}
+	for _, key := range k.keys {
+		if k.expired(key, now) {
+			continue
+		}
+		jwk, err := toJWK(key.Kid, k.method.Alg(), key.Signer.Public())
+		if err != nil {
+			log.Println("Failed to encode JWK:", err)
+			continue
+		}
+		set.Keys = append(set.Keys, *jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+func (k *KeyRing) add(key *SigningKey) {
+	k.keys[key.Kid] = key
+	k.current = key.Kid
+}
+
+func (k *KeyRing) expired(key *SigningKey, now time.Time) bool {
+	return key.RetiredAt != nil && now.After(key.RetiredAt.Add(k.retention))
+}
+
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "ES256":
+		return jwt.SigningMethodES256, nil
+	case "EDDSA":
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+}
+
+func generateKey(method jwt.SigningMethod) (crypto.Signer, error) {
+	switch method {
+	case jwt.SigningMethodRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	default:
+		return nil, errors.New("unsupported signing method")
+	}
+}
+
+func checkKeyType(method jwt.SigningMethod, signer crypto.Signer) error {
+	var ok bool
+	switch method {
+	case jwt.SigningMethodRS256:
+		_, ok = signer.(*rsa.PrivateKey)
+	case jwt.SigningMethodES256:
+		var key *ecdsa.PrivateKey
+		key, ok = signer.(*ecdsa.PrivateKey)
+		ok = ok && key.Curve == elliptic.P256()
+	case jwt.SigningMethodEdDSA:
+		_, ok = signer.(ed25519.PrivateKey)
+	}
+	if !ok {
+		return fmt.Errorf("key type does not match algorithm %s", method.Alg())
+	}
+	return nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("key is not a signing key")
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+// thumbprint derives the kid of generated keys from the SHA-256 of the public key
+func thumbprint(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
+
+func toJWK(kid, alg string, public crypto.PublicKey) (*response.JWK, error) {
+	jwk := &response.JWK{Kid: kid, Alg: alg, Use: "sig"}
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		point, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		// NOTE: uncompressed point is 0x04 || X || Y
+		raw := point.Bytes()[1:]
+		size := len(raw) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = key.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(raw[:size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(raw[size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+	return jwk, nil
+}
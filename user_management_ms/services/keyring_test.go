@@ -0,0 +1,127 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKey writes a P-256 key file as if it was created at modTime
+func writeTestKey(t *testing.T, dir, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func jwksKids(ring *KeyRing) map[string]bool {
+	kids := map[string]bool{}
+	for _, key := range ring.JWKS().Keys {
+		kids[key.Kid] = true
+	}
+	return kids
+}
+
+func TestKeyRingRetiresEarlierKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeTestKey(t, dir, "2024-01.pem", now.Add(-72*time.Hour))
+	writeTestKey(t, dir, "2024-02.pem", now.Add(-48*time.Hour))
+	writeTestKey(t, dir, "2024-03.pem", now.Add(-time.Hour))
+
+	ring, err := NewKeyRing("ES256", []string{filepath.Join(dir, "*.pem")}, 24*time.Hour, false)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	if ring.Current().Kid != "2024-03" {
+		t.Fatalf("signing kid = %s, want 2024-03", ring.Current().Kid)
+	}
+	// NOTE: 2024-01 was retired when 2024-02 was written two days ago, past the one day retention
+	if _, err := ring.Lookup("2024-01"); err == nil {
+		t.Fatal("2024-01 still verifies after its retention")
+	}
+	if _, err := ring.Lookup("2024-02"); err != nil {
+		t.Fatalf("2024-02 should verify within its retention: %v", err)
+	}
+	if kids := jwksKids(ring); len(kids) != 2 || !kids["2024-02"] || !kids["2024-03"] {
+		t.Fatalf("JWKS kids = %v, want 2024-02 and 2024-03", kids)
+	}
+}
+
+func TestKeyRingReloadPublishesBeforeSigning(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "a.pem", time.Now().Add(-time.Hour))
+	ring, err := NewKeyRing("ES256", []string{filepath.Join(dir, "*.pem")}, time.Hour, false)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+
+	writeTestKey(t, dir, "b.pem", time.Now())
+	if err := ring.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if ring.Current().Kid != "a" {
+		t.Fatalf("signing kid after the first reload = %s, want a", ring.Current().Kid)
+	}
+	if !jwksKids(ring)["b"] {
+		t.Fatal("new key b is not published in the JWKS")
+	}
+
+	if err := ring.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if ring.Current().Kid != "b" {
+		t.Fatalf("signing kid after the second reload = %s, want b", ring.Current().Kid)
+	}
+	previous := ring.keys["a"]
+	if previous == nil || previous.RetiredAt == nil {
+		t.Fatal("previous key a should be kept as retired")
+	}
+	if _, err := ring.Lookup("a"); err != nil {
+		t.Fatalf("retired key a should verify within its retention: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "a.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := ring.Lookup("a"); err == nil {
+		t.Fatal("key a still verifies after its file was removed")
+	}
+}
+
+func TestNewKeyRingWithoutKeys(t *testing.T) {
+	if _, err := NewKeyRing("ES256", nil, time.Hour, false); err == nil {
+		t.Fatal("NewKeyRing without key files should fail unless ephemeral keys are allowed")
+	}
+	if _, err := NewKeyRing("ES256", []string{filepath.Join(t.TempDir(), "*.pem")}, time.Hour, false); err == nil {
+		t.Fatal("NewKeyRing should fail when no file matches")
+	}
+	ring, err := NewKeyRing("ES256", nil, time.Hour, true)
+	if err != nil {
+		t.Fatalf("NewKeyRing with ephemeral keys: %v", err)
+	}
+	if ring.Current() == nil {
+		t.Fatal("ephemeral ring has no signing key")
+	}
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+	"user_management_ms/config"
+	"user_management_ms/dtos/request"
+)
+
+const (
+	FactorPassword = "password"
+	FactorPIN      = "pin"
+	FactorTOTP     = "totp"
+)
+
+const (
+	defaultPasswordMaxFailures = 5
+	defaultPINMaxFailures      = 3
+	defaultTOTPMaxFailures     = 5
+	defaultFailureWindow       = 15 * time.Minute
+	defaultBaseLock            = 5 * time.Minute
+	defaultMaxLock             = 24 * time.Hour
+	// lockoutMemory is how long previous lockouts keep escalating the next one
+	lockoutMemory = 7 * 24 * time.Hour
+)
+
+var lockoutFactors = []string{FactorPassword, FactorPIN, FactorTOTP}
+
+// AccountLockedError is returned while a factor is locked after too many failed attempts
+type AccountLockedError struct {
+	Factor     string
+	RetryAfter time.Duration
+}
+
+func (e *AccountLockedError) Error() string {
+	return fmt.Sprintf("too many failed %s attempts, try again later", e.Factor)
+}
+
+// RetryAfterSeconds rounds the wait up so the client never retries too early
+func (e *AccountLockedError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+type ILockoutService interface {
+	Check(userId uint, factor string) error
+	RecordFailure(userId uint, factor string) error
+	RecordSuccess(userId uint, factor string) error
+	Unlock(userId uint, factor string) error
+}
+
+type LockoutService struct {
+	redis IRedisService
+}
+
+func NewLockoutService(redis IRedisService) ILockoutService {
+	return &LockoutService{redis: redis}
+}
+
+// Check returns an *AccountLockedError while the factor of the user is locked
+func (l *LockoutService) Check(userId uint, factor string) error {
+	remaining, err := l.redis.GetLockout(userId, factor)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return &AccountLockedError{Factor: factor, RetryAfter: remaining}
+	}
+	return nil
+}
+
+// RecordFailure counts a failed attempt and locks the factor once the threshold is reached.
+// Every lockout doubles the duration of the next one up to the configured maximum.
+func (l *LockoutService) RecordFailure(userId uint, factor string) error {
+	conf := config.Conf.Application.Lockout
+	failures, err := l.redis.IncrementFailedAttempts(userId, factor, secondsOr(conf.FailureWindowInSeconds, defaultFailureWindow))
+	if err != nil {
+		return err
+	}
+	if failures < int64(maxFailures(factor)) {
+		return nil
+	}
+
+	lockouts, err := l.redis.IncrementLockouts(userId, factor, lockoutMemory)
+	if err != nil {
+		return err
+	}
+	base := secondsOr(conf.BaseLockInSeconds, defaultBaseLock)
+	maxLock := secondsOr(conf.MaxLockInSeconds, defaultMaxLock)
+	duration := maxLock
+	if lockouts < 32 {
+		duration = time.Duration(math.Min(float64(base)*math.Pow(2, float64(lockouts-1)), float64(maxLock)))
+	}
+	if err := l.redis.Lock(userId, factor, duration); err != nil {
+		return err
+	}
+
+	log.Printf("Locked %s of user %d for %s after %d failed attempts", factor, userId, duration, failures)
+	PublishSecurityEvent(&request.SecurityEvent{
+		Type:   "account_locked",
+		UserId: userId,
+		Reason: fmt.Sprintf("too many failed %s attempts", factor),
+		Metadata: map[string]string{
+			"factor":       factor,
+			"locked_until": time.Now().Add(duration).UTC().Format(time.RFC3339),
+		},
+		OccurredAt: time.Now(),
+	})
+	return &AccountLockedError{Factor: factor, RetryAfter: duration}
+}
+
+func (l *LockoutService) RecordSuccess(userId uint, factor string) error {
+	return l.redis.ClearFailedAttempts(userId, factor)
+}
+
+// Unlock lifts the lock of one factor, or of every factor when factor is empty
+func (l *LockoutService) Unlock(userId uint, factor string) error {
+	factors := lockoutFactors
+	if factor != "" {
+		if !slices.Contains(lockoutFactors, factor) {
+			return fmt.Errorf("unknown factor %q", factor)
+		}
+		factors = []string{factor}
+	}
+	for _, f := range factors {
+		if err := l.redis.Unlock(userId, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func maxFailures(factor string) int {
+	conf := config.Conf.Application.Lockout
+	switch factor {
+	case FactorPIN:
+		return positiveOr(conf.PinMaxFailures, defaultPINMaxFailures)
+	case FactorTOTP:
+		return positiveOr(conf.TotpMaxFailures, defaultTOTPMaxFailures)
+	default:
+		return positiveOr(conf.PasswordMaxFailures, defaultPasswordMaxFailures)
+	}
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"user_management_ms/config"
+	"user_management_ms/dtos/request"
+	"user_management_ms/util"
+
+	"github.com/hashicorp/go-uuid"
+)
+
+const (
+	OTPPurposeRegister        = "register"
+	OTPPurposeLogin           = "login"
+	OTPPurposeLoginMFA        = "login_mfa"
+	OTPPurposePhoneChange     = "phone_change"
+	OTPPurposeGooglePhoneLink = "google_phone_link"
+	OTPPurposeGoogleLogin     = "google_login"
+	OTPPurposePINReset        = "pin_reset"
+
+	OTPChannelEmail = "email"
+	OTPChannelPhone = "phone"
+)
+
+const (
+	defaultOTPMaxAttempts = 5
+	defaultOTPLength      = 6
+	defaultOTPExpiry      = 5 * time.Minute
+
+	defaultOTPResendCooldown      = time.Minute
+	defaultOTPResendMaxCooldown   = 30 * time.Minute
+	defaultOTPDailyDestinationCap = 10
+	defaultOTPDailyIPCap          = 30
+	otpSendWindow                 = 24 * time.Hour
+)
+
+var (
+	ErrOTPInvalid         = errors.New("OTP invalid or expired")
+	ErrOTPTooManyAttempts = errors.New("too many invalid OTP attempts, request a new code")
+)
+
+// OTPThrottledError is returned when a code may not be sent yet, RetryAfter tells the client when to try again
+type OTPThrottledError struct {
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (e *OTPThrottledError) Error() string {
+	return e.Reason
+}
+
+// RetryAfterSeconds rounds the wait up so the client never retries too early
+func (e *OTPThrottledError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// OTPChallenge is a pending OTP verification, only hashes of the codes are stored
+type OTPChallenge struct {
+	ChallengeId string            `json:"challengeId"`
+	Purpose     string            `json:"purpose"`
+	UserId      uint              `json:"userId"`
+	CodeHashes  map[string]string `json:"codeHashes"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+}
+
+type IOTPService interface {
+	CreateChallenge(purpose string, userId uint, channels ...string) (string, map[string]string, error)
+	VerifyChallenge(challengeId, purpose string, codes map[string]string) (*OTPChallenge, error)
+	ReserveSend(destinations map[string]string, client *request.ClientInfo) (time.Duration, error)
+	SendChallenge(purpose string, userId uint, destinations map[string]string, client *request.ClientInfo) (string, int, error)
+}
+
+type OTPService struct {
+	redis IRedisService
+}
+
+func NewOTPService(redis IRedisService) IOTPService {
+	return &OTPService{redis: redis}
+}
+
+// CreateChallenge generates a code per channel and stores the challenge, a previous challenge
+// of the same user and purpose is replaced. The plain codes are returned to be delivered.
+func (o *OTPService) CreateChallenge(purpose string, userId uint, channels ...string) (string, map[string]string, error) {
+	challengeId, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ttl := otpExpiry()
+	now := time.Now()
+	challenge := &OTPChallenge{
+		ChallengeId: challengeId,
+		Purpose:     purpose,
+		UserId:      userId,
+		CodeHashes:  make(map[string]string, len(channels)),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	codes := make(map[string]string, len(channels))
+	for _, channel := range channels {
+		policy := otpPolicy(channel)
+		code, err := util.GenerateOTP(policy.Length, policy.Alphabet)
+		if err != nil {
+			return "", nil, err
+		}
+		codes[channel] = code
+		challenge.CodeHashes[channel] = hashOTP(challengeId, channel, code)
+	}
+
+	if err := o.redis.StoreOTPChallenge(challenge, ttl); err != nil {
+		return "", nil, err
+	}
+	return challengeId, codes, nil
+}
+
+// VerifyChallenge checks the codes of every channel of the challenge. The challenge is burned
+// after a successful verification or once the attempt limit is reached.
+func (o *OTPService) VerifyChallenge(challengeId, purpose string, codes map[string]string) (*OTPChallenge, error) {
+	challenge, err := o.redis.GetOTPChallenge(challengeId)
+	if err != nil {
+		return nil, ErrOTPInvalid
+	}
+
+	maxAttempts := positiveOr(config.Conf.Application.Otp.MaxAttempts, defaultOTPMaxAttempts)
+	attempts, err := o.redis.IncrementOTPAttempts(challengeId, time.Until(challenge.ExpiresAt))
+	if err != nil {
+		return nil, err
+	}
+	if attempts > int64(maxAttempts) {
+		_ = o.redis.DeleteOTPChallenge(challenge)
+		return nil, ErrOTPTooManyAttempts
+	}
+
+	valid := challenge.Purpose == purpose && len(codes) == len(challenge.CodeHashes)
+	for channel, expected := range challenge.CodeHashes {
+		actual := hashOTP(challengeId, channel, codes[channel])
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+			valid = false
+		}
+	}
+	if !valid {
+		if attempts == int64(maxAttempts) {
+			_ = o.redis.DeleteOTPChallenge(challenge)
+			return nil, ErrOTPTooManyAttempts
+		}
+		return nil, ErrOTPInvalid
+	}
+
+	if err := o.redis.DeleteOTPChallenge(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// ReserveSend throttles code delivery per destination (channel to address) and client IP. Every send
+// doubles the cooldown of the destination up to the configured maximum, and both destinations and
+// IPs have a daily cap. It returns the time until the next send is allowed.
+func (o *OTPService) ReserveSend(destinations map[string]string, client *request.ClientInfo) (time.Duration, error) {
+	conf := config.Conf.Application.Otp.Resend
+	destinationCap := positiveOr(conf.DailyLimitPerDestination, defaultOTPDailyDestinationCap)
+
+	limits := make([]OTPSendLimit, 0, len(destinations)+1)
+	for channel, address := range destinations {
+		if address == "" {
+			continue
+		}
+		limits = append(limits, OTPSendLimit{
+			Key:        fmt.Sprintf("%s:%s", channel, strings.ToLower(strings.TrimSpace(address))),
+			DailyLimit: destinationCap,
+			Backoff:    true,
+		})
+	}
+	// NOTE: IPs are shared behind NATs, so they only get a daily cap and do not drive the backoff
+	if client != nil && client.IP != "" {
+		limits = append(limits, OTPSendLimit{
+			Key:        fmt.Sprintf("ip:%s", client.IP),
+			DailyLimit: positiveOr(conf.DailyLimitPerIp, defaultOTPDailyIPCap),
+		})
+	}
+	if len(limits) == 0 {
+		return 0, errors.New("no OTP destination")
+	}
+
+	cooldown := secondsOr(conf.CooldownInSeconds, defaultOTPResendCooldown)
+	maxCooldown := secondsOr(conf.MaxCooldownInSeconds, defaultOTPResendMaxCooldown)
+	return o.redis.ReserveOTPSend(limits, cooldown, maxCooldown, otpSendWindow)
+}
+
+// SendChallenge is the only way codes leave the service: it reserves the send against the cooldown and caps,
+// creates a challenge for the channels in destinations (channel to address) and delivers the codes. It returns
+// the challenge and the seconds until the client may ask for another send.
+func (o *OTPService) SendChallenge(purpose string, userId uint, destinations map[string]string, client *request.ClientInfo) (string, int, error) {
+	cooldown, err := o.ReserveSend(destinations, client)
+	if err != nil {
+		return "", 0, err
+	}
+	var channels []string
+	for _, channel := range []string{OTPChannelEmail, OTPChannelPhone} {
+		if destinations[channel] != "" {
+			channels = append(channels, channel)
+		}
+	}
+	challengeId, codes, err := o.CreateChallenge(purpose, userId, channels...)
+	if err != nil {
+		return "", 0, err
+	}
+	if email := destinations[OTPChannelEmail]; email != "" {
+		if err := SendVerifyEmailEventToKafka(&request.VerifyEmailEvent{Email: email, EmailOTP: codes[OTPChannelEmail]}); err != nil {
+			return "", 0, err
+		}
+	}
+	if phone := destinations[OTPChannelPhone]; phone != "" {
+		if err := SendVerifyPhoneNumberEventToKafka(&request.VerifyPhoneEvent{Phone: phone, PhoneOTP: codes[OTPChannelPhone]}); err != nil {
+			return "", 0, err
+		}
+	}
+	return challengeId, int(cooldown.Seconds()), nil
+}
+
+func positiveOr(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+func secondsOr(seconds int, fallback time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return fallback
+}
+
+func otpExpiry() time.Duration {
+	return secondsOr(config.Conf.Application.Otp.ExpiryInSeconds, defaultOTPExpiry)
+}
+
+// otpPolicy returns the configured code format of the channel, falling back to 6 digits
+func otpPolicy(channel string) config.OtpChannel {
+	var policy config.OtpChannel
+	switch channel {
+	case OTPChannelEmail:
+		policy = config.Conf.Application.Otp.Email
+	case OTPChannelPhone:
+		policy = config.Conf.Application.Otp.Phone
+	}
+	if policy.Length <= 0 {
+		policy.Length = defaultOTPLength
+	}
+	if policy.Alphabet == "" {
+		policy.Alphabet = util.DigitsAlphabet
+	}
+	return policy
+}
+
+func hashOTP(challengeId, channel, code string) string {
+	sum := sha256.Sum256([]byte(challengeId + ":" + channel + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
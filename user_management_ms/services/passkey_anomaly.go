@@ -0,0 +1,98 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"user_management_ms/config"
+	"user_management_ms/domain"
+	"user_management_ms/dtos/request"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	PasskeyAnomalySignCount        = "sign_count_regression"
+	PasskeyAnomalyBackupState      = "backup_state_change"
+	PasskeyAnomalyUserVerification = "user_verification_missing"
+)
+
+// Reactions to a passkey anomaly, ordered from mild to strict
+const (
+	AnomalyReactionNone   = ""
+	AnomalyReactionFlag   = "flag"
+	AnomalyReactionMFA    = "mfa"
+	AnomalyReactionReject = "reject"
+)
+
+var ErrPasskeyAnomaly = errors.New("this passkey could not be trusted, sign in another way")
+
+var anomalyReactionRank = map[string]int{
+	AnomalyReactionNone:   0,
+	AnomalyReactionFlag:   1,
+	AnomalyReactionMFA:    2,
+	AnomalyReactionReject: 3,
+}
+
+// detectPasskeyAnomalies compares a verified assertion with the stored passkey. A sign count that did not
+// increase hints at a cloned authenticator, a changed backup state means the key was synced or unsynced.
+func detectPasskeyAnomalies(stored *domain.Passkey, credential *webauthn.Credential) []string {
+	var anomalies []string
+	if credential.Authenticator.CloneWarning {
+		anomalies = append(anomalies, PasskeyAnomalySignCount)
+	}
+	if stored != nil && stored.BackupState != credential.Flags.BackupState {
+		anomalies = append(anomalies, PasskeyAnomalyBackupState)
+	}
+	if !credential.Flags.UserVerified {
+		anomalies = append(anomalies, PasskeyAnomalyUserVerification)
+	}
+	return anomalies
+}
+
+// anomalyReaction returns the strictest configured reaction of the anomalies
+func anomalyReaction(anomalies []string) string {
+	conf := config.Conf.Application.WebAuthn.Anomalies
+	reaction := AnomalyReactionNone
+	for _, anomaly := range anomalies {
+		var configured string
+		switch anomaly {
+		case PasskeyAnomalySignCount:
+			configured = reactionOr(conf.SignCountRegression, AnomalyReactionReject)
+		case PasskeyAnomalyBackupState:
+			configured = reactionOr(conf.BackupStateChange, AnomalyReactionFlag)
+		case PasskeyAnomalyUserVerification:
+			configured = reactionOr(conf.MissingUserVerification, AnomalyReactionMFA)
+		}
+		if anomalyReactionRank[configured] > anomalyReactionRank[reaction] {
+			reaction = configured
+		}
+	}
+	return reaction
+}
+
+// reactionOr falls back for empty and unknown values, a typo must not turn a reaction off
+func reactionOr(reaction, fallback string) string {
+	reaction = strings.ToLower(strings.TrimSpace(reaction))
+	if anomalyReactionRank[reaction] == 0 {
+		return fallback
+	}
+	return reaction
+}
+
+func reportPasskeyAnomalies(userId uint, credentialId []byte, anomalies []string, reaction string) {
+	log.Printf("Passkey anomalies %v for user %d, reaction %s", anomalies, userId, reaction)
+	// NOTE: Reported from inside the login, the assertion response must not wait for a new Kafka producer
+	PublishSecurityEvent(&request.SecurityEvent{
+		Type:   "passkey_anomaly",
+		UserId: userId,
+		Reason: strings.Join(anomalies, ","),
+		Metadata: map[string]string{
+			"credential_id": base64.RawURLEncoding.EncodeToString(credentialId),
+			"reaction":      reaction,
+		},
+		OccurredAt: time.Now(),
+	})
+}
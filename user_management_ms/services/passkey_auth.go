@@ -7,12 +7,17 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
+	"user_management_ms/config"
+	"user_management_ms/domain"
 	"user_management_ms/dtos/request"
 	"user_management_ms/dtos/response"
 	"user_management_ms/repository"
+	"user_management_ms/util"
 
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/hashicorp/go-uuid"
 	"gorm.io/gorm"
 )
@@ -20,20 +25,35 @@ import (
 type IPasskeyService interface {
 	RegisterStart(req *request.StartPasskeyRegistrationRequest) (*protocol.CredentialCreation, error)
 	RegisterFinish(userID uint, r *http.Request) error
-	LoginStart() (*protocol.CredentialAssertion, string, error)
-	LoginFinish(sessionID string, r *http.Request) (*response.Tokens, error)
+	LoginStart(req *request.PasskeyLoginStartRequest) (*protocol.CredentialAssertion, string, error)
+	LoginFinish(sessionID string, r *http.Request, client *request.ClientInfo) (*response.Tokens, error)
+	StepUpStart(userID uint, client string) (*protocol.CredentialAssertion, string, error)
+	StepUpFinish(claims jwt.MapClaims, sessionID string, r *http.Request) (*response.StepUpToken, error)
+	TransactionStart(userID uint, req *request.PasskeyTransactionRequest) (*protocol.CredentialAssertion, string, error)
+	TransactionFinish(userID uint, transactionId string, r *http.Request) (*response.TransactionReceipt, error)
+	ListPasskeys(userID uint) ([]response.Passkey, error)
+	RenamePasskey(userID, passkeyID uint, nickname string) error
+	DeletePasskey(userID, passkeyID uint) error
+	RelatedOrigins() []string
 }
 
+var (
+	ErrPasskeyNotFound = errors.New("passkey not found")
+	ErrNoPasskeys      = errors.New("user has no passkeys register one first")
+	ErrLastLoginMethod = errors.New("cannot delete the last passkey, it is the only way to sign in")
+)
+
 type PasskeyService struct {
 	db       *gorm.DB
 	userRepo repository.IUserRepository
-	wa       *webauthn.WebAuthn
+	rps      *config.RelyingParties
 	jwt      IJWTService
 	redis    IRedisService
+	tokens   ITokenService
 }
 
-func NewPasskeyService(wa *webauthn.WebAuthn, db *gorm.DB, userRepo repository.IUserRepository, redis IRedisService, jwt IJWTService) IPasskeyService {
-	return &PasskeyService{wa: wa, db: db, userRepo: userRepo, redis: redis, jwt: jwt}
+func NewPasskeyService(rps *config.RelyingParties, db *gorm.DB, userRepo repository.IUserRepository, redis IRedisService, jwt IJWTService, tokens ITokenService) IPasskeyService {
+	return &PasskeyService{rps: rps, db: db, userRepo: userRepo, redis: redis, jwt: jwt, tokens: tokens}
 }
 
 // RegisterStart start passkey registration stores temporary session inside redis
@@ -48,8 +68,12 @@ func (ps *PasskeyService) RegisterStart(req *request.StartPasskeyRegistrationReq
 		return nil, errors.New("User doesn't completed registration ")
 	}
 
-	// 2. Begin registration (generates challenge)
-	options, sessionData, err := ps.wa.BeginRegistration(user)
+	// 2. Begin registration (generates challenge) with the relying party of the calling frontend
+	wa, err := ps.rps.ForClient(req.Client)
+	if err != nil {
+		return nil, err
+	}
+	options, sessionData, err := wa.BeginRegistration(user)
 	if err != nil {
 		return nil, err
 	}
@@ -75,16 +99,24 @@ func (ps *PasskeyService) RegisterFinish(userID uint, r *http.Request) error {
 		return err
 	}
 
-	cred, err := ps.wa.FinishRegistration(user, *sessionData, r)
+	wa, err := ps.rps.ForSession(sessionData)
 	if err != nil {
 		return err
 	}
+	cred, err := wa.FinishRegistration(user, *sessionData, r)
+	if err != nil {
+		return err
+	}
+	if err := checkAuthenticatorPolicy(cred); err != nil {
+		return err
+	}
 	authBytes, err := json.Marshal(cred.Authenticator)
 	if err != nil {
 		return err
 	}
 
-	if err := ps.userRepo.SavePasskey(ps.db, authBytes, user.Id, cred); err != nil {
+	name, level := authenticatorMetadata(wa.Config.MDS, cred.Authenticator.AAGUID)
+	if err := ps.userRepo.SavePasskey(ps.db, authBytes, user.Id, cred, name, level); err != nil {
 		return err
 	}
 
@@ -94,11 +126,38 @@ func (ps *PasskeyService) RegisterFinish(userID uint, r *http.Request) error {
 	return nil
 }
 
-func (ps *PasskeyService) LoginStart() (*protocol.CredentialAssertion, string, error) {
+// LoginStart begins a passkey login. Without an email any discoverable passkey of the RP is accepted, with
+// conditional mediation the browser offers them in the username autofill. With an email only the passkeys
+// of that user are allowed, which also works for non-discoverable credentials like older security keys.
+func (ps *PasskeyService) LoginStart(req *request.PasskeyLoginStartRequest) (*protocol.CredentialAssertion, string, error) {
 	// Generate a temporary session ID
 	sessionID, _ := uuid.GenerateUUID() // implement a UUID generator
-	assertion, sessionData, err := ps.wa.BeginDiscoverableLogin()
 
+	wa, err := ps.rps.ForClient(req.Client)
+	if err != nil {
+		return nil, "", err
+	}
+	var (
+		assertion   *protocol.CredentialAssertion
+		sessionData *webauthn.SessionData
+	)
+	switch {
+	case req.Email != "":
+		user, lookupErr := ps.userRepo.GetUserByEmailWithPasskeys(ps.db, req.Email)
+		// NOTE: An unknown email looks the same as a user without passkeys
+		if lookupErr != nil && !errors.Is(lookupErr, gorm.ErrRecordNotFound) {
+			return nil, "", lookupErr
+		}
+		if lookupErr != nil || len(user.Passkeys) == 0 {
+			return nil, "", ErrNoPasskeys
+		}
+		// NOTE: allowCredentials is filled from user.WebAuthnCredentials()
+		assertion, sessionData, err = wa.BeginLogin(user)
+	case req.Conditional:
+		assertion, sessionData, err = wa.BeginDiscoverableMediatedLogin(protocol.MediationConditional)
+	default:
+		assertion, sessionData, err = wa.BeginDiscoverableLogin()
+	}
 	if err != nil {
 		return nil, "", err
 	}
@@ -112,7 +171,7 @@ func (ps *PasskeyService) LoginStart() (*protocol.CredentialAssertion, string, e
 
 // LoginFinish validates the assertion response and updates signCount for the credential used
 // Fixed LoginFinish method
-func (ps *PasskeyService) LoginFinish(sessionID string, r *http.Request) (*response.Tokens, error) {
+func (ps *PasskeyService) LoginFinish(sessionID string, r *http.Request, client *request.ClientInfo) (*response.Tokens, error) {
 	// Retrieve session data from Redis
 	sessionData, err := ps.redis.GetSessionRedis(sessionID)
 	if err != nil {
@@ -142,34 +201,214 @@ func (ps *PasskeyService) LoginFinish(sessionID string, r *http.Request) (*respo
 	user, err := ps.userRepo.FindUserByCredentialID(ps.db, credentialID)
 	if err != nil {
 
-		return nil, errors.New("user has no passkeys register one first")
+		return nil, ErrNoPasskeys
 	}
 
+	// NOTE: A session bound to a user only accepts that user's passkeys, discoverable sessions take the credential's owner
+	if len(sessionData.UserID) > 0 && !bytes.Equal(sessionData.UserID, user.WebAuthnID()) {
+		return nil, errors.New("failed to finish login")
+	}
 	sessionData.UserID = user.WebAuthnID()
+	wa, err := ps.rps.ForSession(sessionData)
+	if err != nil {
+		return nil, err
+	}
 	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-	credential, err := ps.wa.FinishLogin(user, *sessionData, r)
+	credential, err := wa.FinishLogin(user, *sessionData, r)
 	if err != nil {
 		return nil, errors.New("failed to finish login")
 	}
+	// Clean up: delete the temporary session, a challenge is only answered once
+	if err := ps.redis.DeleteSessionRedis(sessionID); err != nil {
+		log.Printf("Warning: failed to delete session: %v", err)
+	}
 
-	// Update the credential's sign count
-	authBytes, _ := json.Marshal(credential.Authenticator)
-	if err := ps.userRepo.UpdatePasskeyAfterLogin(ps.db, credential.ID, authBytes, credential.Authenticator.SignCount); err != nil {
-		log.Printf("Warning: failed to update passkey after login: %v", err)
+	// NOTE: An mfa reaction sends users with 2FA to the TOTP step and everyone else an OTP to their email and phone
+	reaction, err := ps.checkAssertion(user, credential)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := ps.tokens.StartLogin(user, &SessionOptions{
+		LoginMethod: LoginMethodPasskey,
+		Client:      client,
+		RequireMFA:  reaction == AnomalyReactionMFA,
+	})
+	if errors.Is(err, ErrNoSecondFactor) {
+		return nil, ErrPasskeyAnomaly
+	}
+	return tokens, err
+}
+
+// StepUpStart asks for an assertion of one of the passkeys of the signed in user
+func (ps *PasskeyService) StepUpStart(userID uint, client string) (*protocol.CredentialAssertion, string, error) {
+	user, err := ps.userRepo.GetByIDWithPasskeys(ps.db, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(user.Passkeys) == 0 {
+		return nil, "", ErrNoPasskeys
+	}
+
+	sessionID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, "", err
+	}
+	wa, err := ps.rps.ForClient(client)
+	if err != nil {
+		return nil, "", err
+	}
+	assertion, sessionData, err := wa.BeginLogin(user)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ps.redis.StoreSessionRedis(sessionID, sessionData); err != nil {
+		return nil, "", err
+	}
+	return assertion, sessionID, nil
+}
+
+// StepUpFinish verifies the assertion against the passkeys of the session's user and returns an elevated token
+func (ps *PasskeyService) StepUpFinish(claims jwt.MapClaims, sessionID string, r *http.Request) (*response.StepUpToken, error) {
+	userID, _ := claims["sub"].(float64)
+	user, err := ps.userRepo.GetByIDWithPasskeys(ps.db, uint(userID))
+	if err != nil {
+		return nil, err
+	}
+	sessionData, err := ps.redis.GetSessionRedis(sessionID)
+	if err != nil {
+		return nil, errors.New("failed to get session data")
+	}
+	// NOTE: The challenge must have been issued to this user, not to someone else's step-up or a discoverable login
+	if !bytes.Equal(sessionData.UserID, user.WebAuthnID()) {
+		return nil, errors.New("failed to get session data")
 	}
 
-	// Clean up: delete the temporary session
+	wa, err := ps.rps.ForSession(sessionData)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := wa.FinishLogin(user, *sessionData, r)
+	if err != nil {
+		return nil, errors.New("failed to verify passkey")
+	}
 	if err := ps.redis.DeleteSessionRedis(sessionID); err != nil {
 		log.Printf("Warning: failed to delete session: %v", err)
 	}
+	// NOTE: A step-up is a single factor, there is no second factor to fall back to
+	reaction, err := ps.checkAssertion(user, credential)
+	if err != nil {
+		return nil, err
+	}
+	if reaction == AnomalyReactionMFA {
+		return nil, ErrPasskeyAnomaly
+	}
+	return ps.tokens.IssueStepUpToken(claims, AMRWebAuthn)
+}
 
-	tokens, err := ps.jwt.GenerateTokens(user)
+func (ps *PasskeyService) ListPasskeys(userID uint) ([]response.Passkey, error) {
+	passkeys, err := ps.userRepo.ListPasskeys(ps.db, userID)
 	if err != nil {
 		return nil, err
 	}
+	result := make([]response.Passkey, 0, len(passkeys))
+	for _, p := range passkeys {
+		result = append(result, response.Passkey{
+			Id:                 p.ID,
+			Nickname:           p.Nickname,
+			AuthenticatorName:  passkeyAuthenticatorName(&p),
+			AAGUID:             util.FormatAAGUID(p.AAGUID),
+			CreatedAt:          p.CreatedAt,
+			LastUsedAt:         p.LastUsedAt,
+			BackupEligible:     p.BackupEligible,
+			BackupState:        p.BackupState,
+			CertificationLevel: p.CertificationLevel,
+			FlaggedAt:          p.FlaggedAt,
+			FlagReason:         p.FlagReason,
+		})
+	}
+	return result, nil
+}
+
+func (ps *PasskeyService) RenamePasskey(userID, passkeyID uint, nickname string) error {
+	renamed, err := ps.userRepo.RenamePasskey(ps.db, userID, passkeyID, strings.TrimSpace(nickname))
+	if err != nil {
+		return err
+	}
+	if !renamed {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// DeletePasskey removes a passkey of the user, unless it is the last one of a user without a password or Google account
+func (ps *PasskeyService) DeletePasskey(userID, passkeyID uint) error {
+	user, err := ps.userRepo.GetByIDWithPasskeys(ps.db, userID)
+	if err != nil {
+		return err
+	}
+	owned := false
+	for _, p := range user.Passkeys {
+		owned = owned || p.ID == passkeyID
+	}
+	if !owned {
+		return ErrPasskeyNotFound
+	}
+
+	keepLast := user.Password == "" && user.GoogleID == ""
+	deleted, err := ps.userRepo.DeletePasskey(ps.db, userID, passkeyID, keepLast)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		if keepLast {
+			return ErrLastLoginMethod
+		}
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// RelatedOrigins lists the other origins allowed to use the default RP ID
+func (ps *PasskeyService) RelatedOrigins() []string {
+	return ps.rps.RelatedOrigins()
+}
+
+// passkeyAuthenticatorName prefers the name from the metadata service over the built in list of common providers
+func passkeyAuthenticatorName(p *domain.Passkey) string {
+	if p.AuthenticatorName != "" {
+		return p.AuthenticatorName
+	}
+	return util.AuthenticatorName(p.AAGUID)
+}
 
-	return &response.Tokens{
-		AccessToken:  tokens.AccessToken,
-		RefreshToken: tokens.RefreshToken,
-	}, nil
+// checkAssertion looks for anomalies in a verified assertion and records it on the passkey. Rejected
+// assertions leave the stored passkey untouched, otherwise the new sign count and backup state are kept
+// and the passkey is flagged when anything looked off. It returns the reaction to apply.
+func (ps *PasskeyService) checkAssertion(user *domain.User, credential *webauthn.Credential) (string, error) {
+	var stored *domain.Passkey
+	for i := range user.Passkeys {
+		if bytes.Equal(user.Passkeys[i].CredentialID, credential.ID) {
+			stored = &user.Passkeys[i]
+		}
+	}
+
+	anomalies := detectPasskeyAnomalies(stored, credential)
+	reaction := anomalyReaction(anomalies)
+	if len(anomalies) > 0 {
+		reportPasskeyAnomalies(user.Id, credential.ID, anomalies, reaction)
+	}
+	if reaction == AnomalyReactionReject {
+		return reaction, ErrPasskeyAnomaly
+	}
+
+	authBytes, _ := json.Marshal(credential.Authenticator)
+	if err := ps.userRepo.UpdatePasskeyAfterLogin(ps.db, credential.ID, authBytes, credential.Authenticator.SignCount, credential.Flags.BackupState); err != nil {
+		log.Printf("Warning: failed to update passkey after login: %v", err)
+	}
+	if len(anomalies) > 0 {
+		if err := ps.userRepo.FlagPasskey(ps.db, credential.ID, strings.Join(anomalies, ",")); err != nil {
+			log.Printf("Warning: failed to flag passkey: %v", err)
+		}
+	}
+	return reaction, nil
 }
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"user_management_ms/config"
+	"user_management_ms/dtos/request"
+	"user_management_ms/dtos/response"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/hashicorp/go-uuid"
+)
+
+const (
+	passkeyTransactionTTL          = 5 * time.Minute
+	defaultTransactionReceiptValid = 5 * time.Minute
+)
+
+var (
+	ErrTransactionNotFound = errors.New("transaction not found or expired")
+	ErrTransactionMismatch = errors.New("assertion does not match the transaction")
+)
+
+// TransactionPayloadHash is the base64url (no padding) SHA-256 of the canonical JSON of the operation:
+//
+//	{"action":"<action>","payload":{"<key>":"<value>",...}}
+//
+// without whitespace or trailing newline, payload keys sorted by their bytes, a missing payload written as {}
+// and strings escaped as encoding/json does except that <, > and & stay literal. Services holding the same
+// operation recompute it this way and compare it with the payload_hash of the receipt.
+func TransactionPayloadHash(action string, payload map[string]string) string {
+	if payload == nil {
+		payload = map[string]string{}
+	}
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	// NOTE: json.Marshal turns <, > and & into \u003c..., which other languages do not do by default
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(struct {
+		Action  string            `json:"action"`
+		Payload map[string]string `json:"payload"`
+	}{action, payload})
+	sum := sha256.Sum256(bytes.TrimSuffix(canonical.Bytes(), []byte("\n")))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// transactionChallenge binds the WebAuthn challenge to the transaction so the signature covers the payload
+func transactionChallenge(transactionId, payloadHash string) []byte {
+	sum := sha256.Sum256([]byte(transactionId + ":" + payloadHash))
+	return sum[:]
+}
+
+// TransactionStart registers the operation server side and asks for a user verified assertion whose
+// challenge is derived from it
+func (ps *PasskeyService) TransactionStart(userID uint, req *request.PasskeyTransactionRequest) (*protocol.CredentialAssertion, string, error) {
+	user, err := ps.userRepo.GetByIDWithPasskeys(ps.db, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(user.Passkeys) == 0 {
+		return nil, "", ErrNoPasskeys
+	}
+
+	transactionId, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, "", err
+	}
+	wa, err := ps.rps.ForClient(req.Client)
+	if err != nil {
+		return nil, "", err
+	}
+	payloadHash := TransactionPayloadHash(req.Action, req.Payload)
+	assertion, sessionData, err := wa.BeginLogin(user,
+		webauthn.WithChallenge(transactionChallenge(transactionId, payloadHash)),
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tx := &PasskeyTransaction{
+		TransactionId: transactionId,
+		UserId:        userID,
+		Action:        req.Action,
+		Payload:       req.Payload,
+		PayloadHash:   payloadHash,
+		Session:       sessionData,
+		CreatedAt:     time.Now(),
+	}
+	if err := ps.redis.StorePasskeyTransaction(tx, passkeyTransactionTTL); err != nil {
+		return nil, "", err
+	}
+	return assertion, transactionId, nil
+}
+
+// TransactionFinish verifies the assertion for the transaction and signs a receipt of the approval.
+// The owner's transaction is consumed first so it can be approved only once, a failed attempt has to start over.
+func (ps *PasskeyService) TransactionFinish(userID uint, transactionId string, r *http.Request) (*response.TransactionReceipt, error) {
+	tx, err := ps.redis.ConsumePasskeyTransaction(transactionId, userID)
+	if err != nil || tx.Session == nil {
+		return nil, ErrTransactionNotFound
+	}
+	user, err := ps.userRepo.GetByIDWithPasskeys(ps.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: Never trust the stored session alone, the challenge must still be the one derived from the payload
+	expected := base64.RawURLEncoding.EncodeToString(transactionChallenge(tx.TransactionId, tx.PayloadHash))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(tx.Session.Challenge)) != 1 || !bytes.Equal(tx.Session.UserID, user.WebAuthnID()) {
+		return nil, ErrTransactionMismatch
+	}
+
+	wa, err := ps.rps.ForSession(tx.Session)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := wa.FinishLogin(user, *tx.Session, r)
+	if err != nil {
+		return nil, errors.New("failed to verify passkey")
+	}
+	// NOTE: Like a step-up the approval is a single factor, an assertion needing a second factor is refused
+	reaction, err := ps.checkAssertion(user, credential)
+	if err != nil {
+		return nil, err
+	}
+	if reaction == AnomalyReactionMFA {
+		return nil, ErrPasskeyAnomaly
+	}
+
+	validity := secondsOr(config.Conf.Application.WebAuthn.TransactionReceiptValidityInSeconds, defaultTransactionReceiptValid)
+	receipt, err := ps.jwt.GenerateTransactionReceipt(userID, tx.TransactionId, tx.Action, tx.PayloadHash, validity)
+	if err != nil {
+		return nil, err
+	}
+	return &response.TransactionReceipt{
+		TransactionId: tx.TransactionId,
+		Receipt:       receipt,
+		PayloadHash:   tx.PayloadHash,
+		ExpiresIn:     int(validity.Seconds()),
+	}, nil
+}
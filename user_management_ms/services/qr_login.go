@@ -0,0 +1,292 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+	"user_management_ms/config"
+	"user_management_ms/dtos/request"
+	"user_management_ms/dtos/response"
+	"user_management_ms/util"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/skip2/go-qrcode"
+)
+
+// QR login goes PENDING -> SCANNED -> APPROVED. The phone may reject it once scanned (REJECTED) and the
+// desktop may cancel it until it is approved (CANCELLED). The desktop asking for the code gets a secret it
+// needs to watch the login and collect the tokens, the session id inside the QR code alone is worth nothing.
+// The phone scans first and shows the requesting device, only the same phone session can approve afterwards.
+const (
+	QrLoginTTL = 10 * time.Minute
+	// defaultQrLoginSize is the PNG size in pixels when qr-login.size is not set
+	defaultQrLoginSize    = 256
+	defaultQrLoginBaseURL = "https://mocadomain.com/qr-login"
+	// qrLoginKeepAlive is how often a watching desktop gets a keep-alive and the state is re-read
+	qrLoginKeepAlive = 15 * time.Second
+)
+
+var (
+	ErrQrLoginNotFound = errors.New("qr login not found or expired")
+	ErrQrLoginSecret   = errors.New("invalid qr login secret")
+	ErrQrLoginState    = errors.New("qr login is not waiting for this step")
+)
+
+func (u *UserService) RequestLoginQr(req *request.QrLoginRequest, client *request.ClientInfo) (*response.QrLoginChallenge, error) {
+	sessionId, _ := uuid.GenerateUUID()
+	secret, err := newQrLoginSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := u.redis.StoreLoginSessionRedis(sessionId, hashQrLoginSecret(secret), client); err != nil {
+		return nil, err
+	}
+	payload, err := qrLoginPayload(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := &response.QrLoginChallenge{
+		SessionId: sessionId,
+		Secret:    secret,
+		Payload:   payload,
+		ExpiresIn: int(QrLoginTTL.Seconds()),
+	}
+	size := positiveOr(config.Conf.Application.QrLogin.Size, defaultQrLoginSize)
+	switch req.Format {
+	case request.QrFormatRaw:
+	case request.QrFormatSVG:
+		if challenge.SVG, err = util.QRCodeSVG(payload, size); err != nil {
+			return nil, err
+		}
+	default:
+		png, err := qrcode.Encode(payload, qrcode.Medium, size)
+		if err != nil {
+			return nil, err
+		}
+		challenge.Base64PNG = base64.StdEncoding.EncodeToString(png)
+	}
+	return challenge, nil
+}
+
+// qrLoginPayload builds the link in the QR code from the configured app link or deep link
+func qrLoginPayload(sessionId string) (string, error) {
+	base := config.Conf.Application.QrLogin.BaseURL
+	if base == "" {
+		base = defaultQrLoginBaseURL
+	}
+	link, err := url.Parse(base)
+	if err != nil || link.Scheme == "" {
+		return "", fmt.Errorf("invalid qr login base url %q", base)
+	}
+	query := link.Query()
+	query.Set("sessionId", sessionId)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// ScanLoginQr claims the QR login for the scanning phone session and returns the requesting device for review
+func (u *UserService) ScanLoginQr(userId uint, scannerSessionId, sessionId string) (*response.QrLoginScan, error) {
+	session, err := u.redis.GetLoginSessionRedis(sessionId)
+	if err != nil {
+		return nil, ErrQrLoginNotFound
+	}
+	// NOTE: Scanning twice from the same phone session is harmless, another phone cannot take it over
+	alreadyScanned := session.Status == string(response.StatusScanned) && session.UserId == userId && session.ScannedBy == scannerSessionId
+	if session.Status != string(response.StatusPending) && !alreadyScanned {
+		return nil, ErrQrLoginState
+	}
+	if !alreadyScanned {
+		now := time.Now()
+		session.Status = string(response.StatusScanned)
+		session.UserId = userId
+		session.ScannedBy = scannerSessionId
+		session.ScannedAt = &now
+		if err := u.redis.UpdateLoginSessionRedis(sessionId, session); err != nil {
+			return nil, err
+		}
+	}
+
+	scan := &response.QrLoginScan{SessionId: sessionId, RequestedAt: session.CreatedAt}
+	if session.Client != nil {
+		scan.DeviceName = session.Client.DeviceName
+		scan.UserAgent = session.Client.UserAgent
+		scan.IP = session.Client.IP
+		scan.Location = session.Client.Location
+	}
+	return scan, nil
+}
+
+// ApproveLoginQr confirms a scanned QR login, it must come from the phone session that scanned it
+func (u *UserService) ApproveLoginQr(userId uint, approverSessionId, sessionId string) error {
+	session, err := u.redis.GetLoginSessionRedis(sessionId)
+	if err != nil {
+		return ErrQrLoginNotFound
+	}
+	if session.Status != string(response.StatusScanned) || session.UserId != userId || session.ScannedBy != approverSessionId {
+		return ErrQrLoginState
+	}
+	session.Status = string(response.StatusApproved)
+	session.ApprovedBy = approverSessionId
+
+	return u.redis.UpdateLoginSessionRedis(sessionId, session)
+}
+
+// RejectLoginQr lets the phone that scanned the code deny the login, e.g. when it does not recognise the device
+func (u *UserService) RejectLoginQr(userId uint, scannerSessionId, sessionId string) error {
+	session, err := u.redis.GetLoginSessionRedis(sessionId)
+	if err != nil {
+		return ErrQrLoginNotFound
+	}
+	if session.Status != string(response.StatusScanned) || session.UserId != userId || session.ScannedBy != scannerSessionId {
+		return ErrQrLoginState
+	}
+	session.Status = string(response.StatusRejected)
+
+	return u.redis.UpdateLoginSessionRedis(sessionId, session)
+}
+
+// CancelLoginQr lets the desktop withdraw its request before it is approved, the phone can no longer act on it
+func (u *UserService) CancelLoginQr(sessionId, secret string) error {
+	session, err := u.redis.GetLoginSessionRedis(sessionId)
+	if err != nil {
+		return ErrQrLoginNotFound
+	}
+	if !qrLoginSecretMatches(session, secret) {
+		return ErrQrLoginSecret
+	}
+	if session.Status != string(response.StatusPending) && session.Status != string(response.StatusScanned) {
+		return ErrQrLoginState
+	}
+	session.Status = string(response.StatusCancelled)
+
+	return u.redis.UpdateLoginSessionRedis(sessionId, session)
+}
+
+// AuthorizeLoginQr checks the desktop's secret before a status stream is opened
+func (u *UserService) AuthorizeLoginQr(sessionId, secret string) error {
+	session, err := u.redis.GetLoginSessionRedis(sessionId)
+	if err != nil {
+		return ErrQrLoginNotFound
+	}
+	if !qrLoginSecretMatches(session, secret) {
+		return ErrQrLoginSecret
+	}
+	return nil
+}
+
+func (u *UserService) CheckLoginQr(sessionId, secret string) (*response.QrLoginResponse, error) {
+	session, err := u.redis.GetLoginSessionRedis(sessionId)
+	if err != nil {
+		return &response.QrLoginResponse{Status: response.StatusExpired}, nil
+	}
+	if !qrLoginSecretMatches(session, secret) {
+		return nil, ErrQrLoginSecret
+	}
+
+	switch response.QrLoginStatus(session.Status) {
+	case response.StatusPending, response.StatusScanned, response.StatusRejected, response.StatusCancelled:
+		return &response.QrLoginResponse{Status: response.QrLoginStatus(session.Status)}, nil
+	case response.StatusApproved:
+		// NOTE: Consumed atomically, a second poll racing this one finds nothing and sees EXPIRED
+		session, err = u.redis.ConsumeLoginSessionRedis(sessionId)
+		if err != nil || session.Status != string(response.StatusApproved) {
+			return &response.QrLoginResponse{Status: response.StatusExpired}, nil
+		}
+		user, err := u.repo.GetByID(u.db, session.UserId)
+		if err != nil {
+			return nil, err
+		}
+		// QR login creates its own session for the desktop that requested the code
+		tokens, err := u.tokens.StartLogin(user, &SessionOptions{
+			LoginMethod: LoginMethodQR,
+			Client:      session.Client,
+			ApprovedBy:  session.ApprovedBy,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &response.QrLoginResponse{
+			Status: response.StatusApproved,
+			Tokens: tokens,
+		}, nil
+
+	default:
+		return &response.QrLoginResponse{Status: response.StatusExpired}, nil
+	}
+}
+
+// WatchLoginQr pushes every state change of the QR login to emit until it reaches a final state. emit gets
+// nil as a keep-alive, its error (usually a disconnected client) stops the watch.
+func (u *UserService) WatchLoginQr(sessionId, secret string, emit func(*response.QrLoginResponse) error) error {
+	// NOTE: Subscribe before the first read so no change between the two is missed
+	sub := u.redis.SubscribeLoginSession(sessionId)
+	defer sub.Close()
+	events := sub.Channel()
+	keepAlive := time.NewTicker(qrLoginKeepAlive)
+	defer keepAlive.Stop()
+	deadline := time.NewTimer(QrLoginTTL)
+	defer deadline.Stop()
+
+	var last response.QrLoginStatus
+	for {
+		status, err := u.CheckLoginQr(sessionId, secret)
+		if err != nil {
+			return err
+		}
+		if status.Status != last {
+			if err := emit(status); err != nil {
+				return err
+			}
+			last = status.Status
+		}
+		if qrLoginFinished(status.Status) {
+			return nil
+		}
+
+		select {
+		case <-events:
+		case <-keepAlive.C:
+			if err := emit(nil); err != nil {
+				return err
+			}
+		case <-deadline.C:
+			return emit(&response.QrLoginResponse{Status: response.StatusExpired})
+		}
+	}
+}
+
+func qrLoginFinished(status response.QrLoginStatus) bool {
+	switch status {
+	case response.StatusApproved, response.StatusRejected, response.StatusCancelled, response.StatusExpired:
+		return true
+	}
+	return false
+}
+
+func newQrLoginSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func hashQrLoginSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func qrLoginSecretMatches(session *RedisSession, secret string) bool {
+	if session.SecretHash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(session.SecretHash), []byte(hashQrLoginSecret(secret))) == 1
+}
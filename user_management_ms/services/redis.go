@@ -3,37 +3,142 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 	"user_management_ms/config"
+	"user_management_ms/dtos/request"
 
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/hashicorp/go-uuid"
 	"github.com/redis/go-redis/v9"
 )
 
 var ctx = context.Background()
 
 type IRedisService interface {
-	SetRefreshToken(userId uint, refreshToken string) error
-	GetRefreshToken(userId uint) (string, error)
-	DelRefreshToken(userId uint)
+	StoreRefreshToken(record *RefreshTokenRecord) error
+	GetRefreshToken(jti string) (*RefreshTokenRecord, error)
+	MarkRefreshTokenRotated(jti string) (bool, error)
+	SaveRefreshFamily(family *RefreshTokenFamily) error
+	GetRefreshFamily(familyId string) (*RefreshTokenFamily, error)
+	RevokeRefreshFamily(familyId string) error
+	GetUserRefreshFamilies(userId uint) ([]string, error)
+	RemoveUserRefreshFamily(userId uint, familyId string) error
+	DenyAccessToken(jti string, ttl time.Duration) error
+	RevokeUserTokensBefore(userId uint, before time.Time) error
+	IsAccessTokenRevoked(jti, familyId string, userId uint, issuedAt time.Time) (bool, error)
 	StoreSessionRedis(sessionId string, sessionData *webauthn.SessionData) error
 	GetSessionRedis(sessionId string) (*webauthn.SessionData, error)
 	DeleteSessionRedis(sessionId string) error
 	StoreRegistrationSessionRedis(userID uint, sessionData *webauthn.SessionData) error
 	GetRegistrationSessionRedis(userID uint) (*webauthn.SessionData, error)
 	DeleteRegistrationSessionRedis(userID uint) error
-	StoreLoginSessionRedis(sessionId string) error
+	StoreLoginSessionRedis(sessionId, secretHash string, client *request.ClientInfo) error
 	GetLoginSessionRedis(sessionId string) (*RedisSession, error)
+	ConsumeLoginSessionRedis(sessionId string) (*RedisSession, error)
 	DeleteLoginSessionRedis(sessionId string) error
 	UpdateLoginSessionRedis(sessionId string, session *RedisSession) error
+	SubscribeLoginSession(sessionId string) *redis.PubSub
+	StoreOTPChallenge(challenge *OTPChallenge, ttl time.Duration) error
+	GetOTPChallenge(challengeId string) (*OTPChallenge, error)
+	HasActiveOTPChallenge(purpose string, userId uint) bool
+	IncrementOTPAttempts(challengeId string, ttl time.Duration) (int64, error)
+	DeleteOTPChallenge(challenge *OTPChallenge) error
+	ReserveOTPSend(limits []OTPSendLimit, baseCooldown, maxCooldown, window time.Duration) (time.Duration, error)
+	HitRateLimit(key string, limit int, window time.Duration) (*RateLimitResult, error)
+	StoreMFATicket(ticket *MFATicket, ttl time.Duration) error
+	GetMFATicket(ticketId string) (*MFATicket, error)
+	ConsumeMFATicket(ticketId string) (*MFATicket, error)
+	StorePendingTOTPSecret(userId uint, secret string, ttl time.Duration) error
+	GetPendingTOTPSecret(userId uint) (string, error)
+	DeletePendingTOTPSecret(userId uint) error
+	GetLockout(userId uint, factor string) (time.Duration, error)
+	IncrementFailedAttempts(userId uint, factor string, window time.Duration) (int64, error)
+	Lock(userId uint, factor string, duration time.Duration) error
+	IncrementLockouts(userId uint, factor string, memory time.Duration) (int64, error)
+	ClearFailedAttempts(userId uint, factor string) error
+	Unlock(userId uint, factor string) error
+	StorePasskeyTransaction(tx *PasskeyTransaction, ttl time.Duration) error
+	ConsumePasskeyTransaction(transactionId string, userId uint) (*PasskeyTransaction, error)
+	StoreOAuthAttempt(attempt *OAuthAttempt, ttl time.Duration) error
+	AcquireLock(name string, ttl time.Duration) (string, bool, error)
+	ReleaseLock(name, token string) error
+	ConsumeOAuthAttempt(state string) (*OAuthAttempt, error)
 }
 
+// RedisSession is a QR login. Only the desktop that asked for the code knows the secret behind SecretHash,
+// the phone that scanned it (ScannedBy) is the only one allowed to approve it.
 type RedisSession struct {
-	SessionId string `json:"sessionId"`
-	Status    string `json:"status"`
-	UserId    uint   `json:"userId"`
+	SessionId  string              `json:"sessionId"`
+	Status     string              `json:"status"`
+	UserId     uint                `json:"userId"`
+	Client     *request.ClientInfo `json:"client"`
+	SecretHash string              `json:"secretHash"`
+	ScannedBy  string              `json:"scannedBy,omitempty"`
+	ScannedAt  *time.Time          `json:"scannedAt,omitempty"`
+	ApprovedBy string              `json:"approvedBy"`
+	CreatedAt  time.Time           `json:"createdAt"`
 }
+
+// RefreshTokenFamily is the chain of refresh tokens issued for one login on one device,
+// it doubles as the user's session record
+type RefreshTokenFamily struct {
+	FamilyId    string    `json:"familyId"`
+	UserId      uint      `json:"userId"`
+	CurrentJti  string    `json:"currentJti"`
+	DeviceName  string    `json:"deviceName"`
+	UserAgent   string    `json:"userAgent"`
+	IP          string    `json:"ip"`
+	LoginMethod string    `json:"loginMethod"`
+	ApprovedBy  string    `json:"approvedBy,omitempty"`
+	AMR         []string  `json:"amr,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastUsedAt  time.Time `json:"lastUsedAt"`
+}
+
+// RefreshTokenRecord is a single refresh token of a family, ParentJti points to the token it replaced
+type RefreshTokenRecord struct {
+	Jti       string    `json:"jti"`
+	FamilyId  string    `json:"familyId"`
+	ParentJti string    `json:"parentJti"`
+	UserId    uint      `json:"userId"`
+	IssuedAt  time.Time `json:"issuedAt"`
+}
+
+// PasskeyTransaction is a sensitive operation waiting for approval with a passkey, the WebAuthn challenge
+// is derived from its id and payload hash
+type PasskeyTransaction struct {
+	TransactionId string                `json:"transactionId"`
+	UserId        uint                  `json:"userId"`
+	Action        string                `json:"action"`
+	Payload       map[string]string     `json:"payload"`
+	PayloadHash   string                `json:"payloadHash"`
+	Session       *webauthn.SessionData `json:"session"`
+	CreatedAt     time.Time             `json:"createdAt"`
+}
+
+// OAuthAttempt is one Google login started by this service, the callback must bring back its state
+type OAuthAttempt struct {
+	State     string    `json:"state"`
+	Verifier  string    `json:"verifier"`
+	Nonce     string    `json:"nonce"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// MFATicket is a login that passed its primary factor and waits for the second factor, the TOTP code
+// or the codes of the OTP challenge
+type MFATicket struct {
+	TicketId    string              `json:"ticketId"`
+	UserId      uint                `json:"userId"`
+	LoginMethod string              `json:"loginMethod"`
+	Factor      string              `json:"factor"`
+	ChallengeId string              `json:"challengeId,omitempty"`
+	Client      *request.ClientInfo `json:"client,omitempty"`
+	ApprovedBy  string              `json:"approvedBy,omitempty"`
+	CreatedAt   time.Time           `json:"createdAt"`
+}
+
 type RedisService struct {
 	rdb *redis.Client
 }
@@ -42,16 +147,112 @@ func NewRedisService(rdb *redis.Client) *RedisService {
 	return &RedisService{rdb: rdb}
 }
 
-func (s *RedisService) SetRefreshToken(userId uint, refreshToken string) error {
-	return s.rdb.SetEx(ctx, fmt.Sprintf("refresh_%d", userId), refreshToken, time.Duration(config.Conf.Application.Security.TokenValidityInSecondsForRememberMe)*time.Second).Err()
+func refreshTTL() time.Duration {
+	return time.Duration(config.Conf.Application.Security.TokenValidityInSecondsForRememberMe) * time.Second
+}
+
+func accessTTL() time.Duration {
+	return time.Duration(config.Conf.Application.Security.TokenValidityInSeconds) * time.Second
+}
+
+func (s *RedisService) StoreRefreshToken(record *RefreshTokenRecord) error {
+	data, _ := json.Marshal(record)
+	return s.rdb.Set(ctx, fmt.Sprintf("refresh_token:%s", record.Jti), data, refreshTTL()).Err()
+}
+
+func (s *RedisService) GetRefreshToken(jti string) (*RefreshTokenRecord, error) {
+	val, err := s.rdb.Get(ctx, fmt.Sprintf("refresh_token:%s", jti)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var record RefreshTokenRecord
+	if err := json.Unmarshal([]byte(val), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// MarkRefreshTokenRotated atomically flags a refresh token as used, false means it was already used before
+func (s *RedisService) MarkRefreshTokenRotated(jti string) (bool, error) {
+	return s.rdb.SetNX(ctx, fmt.Sprintf("refresh_rotated:%s", jti), 1, refreshTTL()).Result()
+}
+
+func (s *RedisService) SaveRefreshFamily(family *RefreshTokenFamily) error {
+	data, _ := json.Marshal(family)
+	familiesKey := fmt.Sprintf("refresh_families:%d", family.UserId)
+	pipe := s.rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("refresh_family:%s", family.FamilyId), data, refreshTTL())
+	pipe.SAdd(ctx, familiesKey, family.FamilyId)
+	pipe.Expire(ctx, familiesKey, refreshTTL())
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisService) GetRefreshFamily(familyId string) (*RefreshTokenFamily, error) {
+	val, err := s.rdb.Get(ctx, fmt.Sprintf("refresh_family:%s", familyId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var family RefreshTokenFamily
+	if err := json.Unmarshal([]byte(val), &family); err != nil {
+		return nil, err
+	}
+	return &family, nil
+}
+
+// RevokeRefreshFamily removes the family, every refresh and access token of it is rejected from now on
+func (s *RedisService) RevokeRefreshFamily(familyId string) error {
+	family, err := s.GetRefreshFamily(familyId)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("revoked_family:%s", familyId), 1, accessTTL())
+	if family != nil {
+		pipe.Del(ctx, fmt.Sprintf("refresh_family:%s", familyId))
+		pipe.SRem(ctx, fmt.Sprintf("refresh_families:%d", family.UserId), familyId)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisService) GetUserRefreshFamilies(userId uint) ([]string, error) {
+	return s.rdb.SMembers(ctx, fmt.Sprintf("refresh_families:%d", userId)).Result()
+}
+
+func (s *RedisService) RemoveUserRefreshFamily(userId uint, familyId string) error {
+	return s.rdb.SRem(ctx, fmt.Sprintf("refresh_families:%d", userId), familyId).Err()
+}
+
+// DenyAccessToken puts the jti on the denylist for the rest of the token lifetime
+func (s *RedisService) DenyAccessToken(jti string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	return s.rdb.Set(ctx, fmt.Sprintf("revoked_access:%s", jti), 1, ttl).Err()
 }
 
-func (s *RedisService) GetRefreshToken(userId uint) (string, error) {
-	return s.rdb.Get(ctx, fmt.Sprintf("refresh_%d", userId)).Result()
+// RevokeUserTokensBefore rejects every access token of the user issued until the given time.
+// NOTE: Kept in milliseconds, with whole seconds a login right after logout-all would be revoked too
+func (s *RedisService) RevokeUserTokensBefore(userId uint, before time.Time) error {
+	return s.rdb.Set(ctx, fmt.Sprintf("revoked_before_ms:%d", userId), before.UnixMilli(), accessTTL()).Err()
 }
 
-func (s *RedisService) DelRefreshToken(userId uint) {
-	s.rdb.Del(ctx, fmt.Sprintf("refresh_%d", userId))
+func (s *RedisService) IsAccessTokenRevoked(jti, familyId string, userId uint, issuedAt time.Time) (bool, error) {
+	pipe := s.rdb.Pipeline()
+	denied := pipe.Exists(ctx, fmt.Sprintf("revoked_access:%s", jti))
+	familyRevoked := pipe.Exists(ctx, fmt.Sprintf("revoked_family:%s", familyId))
+	revokedBefore := pipe.Get(ctx, fmt.Sprintf("revoked_before_ms:%d", userId))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	if denied.Val() > 0 || familyRevoked.Val() > 0 {
+		return true, nil
+	}
+	if before, err := revokedBefore.Int64(); err == nil && issuedAt.UnixMilli() <= before {
+		return true, nil
+	}
+	return false, nil
 }
 
 func (s *RedisService) StoreSessionRedis(sessionId string, sessionData *webauthn.SessionData) error {
@@ -97,14 +298,18 @@ func (s *RedisService) DeleteRegistrationSessionRedis(userId uint) error {
 	return s.rdb.Del(ctx, fmt.Sprintf("webauthn:%d", userId)).Err()
 }
 
-func (s *RedisService) StoreLoginSessionRedis(sessionId string) error {
+func (s *RedisService) StoreLoginSessionRedis(sessionId, secretHash string, client *request.ClientInfo) error {
 	redisSession := &RedisSession{
-		Status: "PENDING",
-		UserId: 0,
+		SessionId:  sessionId,
+		Status:     "PENDING",
+		UserId:     0,
+		Client:     client,
+		SecretHash: secretHash,
+		CreatedAt:  time.Now(),
 	}
 	data, _ := json.Marshal(redisSession)
 
-	return s.rdb.Set(ctx, fmt.Sprintf("qrlogin:%s", sessionId), data, 10*time.Minute).Err()
+	return s.rdb.Set(ctx, fmt.Sprintf("qrlogin:%s", sessionId), data, QrLoginTTL).Err()
 }
 
 func (s *RedisService) GetLoginSessionRedis(sessionId string) (*RedisSession, error) {
@@ -120,12 +325,395 @@ func (s *RedisService) GetLoginSessionRedis(sessionId string) (*RedisSession, er
 	return &redisSession, err
 }
 
+// ConsumeLoginSessionRedis atomically reads and deletes the QR login so the tokens are handed out once
+func (s *RedisService) ConsumeLoginSessionRedis(sessionId string) (*RedisSession, error) {
+	val, err := s.rdb.GetDel(ctx, fmt.Sprintf("qrlogin:%s", sessionId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var redisSession RedisSession
+	if err := json.Unmarshal([]byte(val), &redisSession); err != nil {
+		return nil, err
+	}
+	return &redisSession, nil
+}
+
 func (s *RedisService) DeleteLoginSessionRedis(sessionId string) error {
 	return s.rdb.Del(ctx, fmt.Sprintf("qrlogin:%s", sessionId)).Err()
 }
 
+// UpdateLoginSessionRedis saves the new state keeping the original expiry and notifies the watching desktop
 func (s *RedisService) UpdateLoginSessionRedis(sessionId string, session *RedisSession) error {
-	s.rdb.Del(ctx, fmt.Sprintf("qrlogin:%s", sessionId))
 	data, _ := json.Marshal(session)
-	return s.rdb.Set(ctx, fmt.Sprintf("qrlogin:%s", sessionId), data, 10*time.Minute).Err()
+	if err := s.rdb.SetArgs(ctx, fmt.Sprintf("qrlogin:%s", sessionId), data, redis.SetArgs{KeepTTL: true, Mode: "XX"}).Err(); err != nil {
+		return err
+	}
+	return s.rdb.Publish(ctx, fmt.Sprintf("qrlogin_events:%s", sessionId), session.Status).Err()
+}
+
+// SubscribeLoginSession listens for state changes of a QR login, the caller closes the subscription
+func (s *RedisService) SubscribeLoginSession(sessionId string) *redis.PubSub {
+	return s.rdb.Subscribe(ctx, fmt.Sprintf("qrlogin_events:%s", sessionId))
+}
+
+// StoreOTPChallenge saves the challenge and burns the previous one of the same user and purpose
+func (s *RedisService) StoreOTPChallenge(challenge *OTPChallenge, ttl time.Duration) error {
+	activeKey := fmt.Sprintf("otp_active:%s:%d", challenge.Purpose, challenge.UserId)
+	if previous, err := s.rdb.Get(ctx, activeKey).Result(); err == nil {
+		s.rdb.Del(ctx, fmt.Sprintf("otp:%s", previous), fmt.Sprintf("otp_attempts:%s", previous))
+	}
+	data, _ := json.Marshal(challenge)
+	pipe := s.rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("otp:%s", challenge.ChallengeId), data, ttl)
+	pipe.Set(ctx, activeKey, challenge.ChallengeId, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisService) GetOTPChallenge(challengeId string) (*OTPChallenge, error) {
+	val, err := s.rdb.Get(ctx, fmt.Sprintf("otp:%s", challengeId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var challenge OTPChallenge
+	if err := json.Unmarshal([]byte(val), &challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func (s *RedisService) HasActiveOTPChallenge(purpose string, userId uint) bool {
+	n, err := s.rdb.Exists(ctx, fmt.Sprintf("otp_active:%s:%d", purpose, userId)).Result()
+	return err == nil && n > 0
+}
+
+func (s *RedisService) IncrementOTPAttempts(challengeId string, ttl time.Duration) (int64, error) {
+	key := fmt.Sprintf("otp_attempts:%s", challengeId)
+	pipe := s.rdb.TxPipeline()
+	attempts := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return attempts.Val(), nil
+}
+
+func (s *RedisService) DeleteOTPChallenge(challenge *OTPChallenge) error {
+	activeKey := fmt.Sprintf("otp_active:%s:%d", challenge.Purpose, challenge.UserId)
+	keys := []string{
+		fmt.Sprintf("otp:%s", challenge.ChallengeId),
+		fmt.Sprintf("otp_attempts:%s", challenge.ChallengeId),
+	}
+	if active, err := s.rdb.Get(ctx, activeKey).Result(); err == nil && active == challenge.ChallengeId {
+		keys = append(keys, activeKey)
+	}
+	return s.rdb.Del(ctx, keys...).Err()
+}
+
+// OTPSendLimit throttles OTP sends to one destination (email, phone) or from one client IP
+type OTPSendLimit struct {
+	Key        string
+	DailyLimit int
+	// Backoff makes the cooldown grow with the number of sends counted under this key
+	Backoff bool
+}
+
+// reserveOTPSendScript checks the cooldown and daily counters of every key and, when all of
+// them allow it, counts the send and starts the next cooldown in one atomic step.
+// KEYS: counter keys followed by cooldown keys. ARGV: base cooldown ms, max cooldown ms,
+// window ms, then a daily limit and a backoff flag per counter key.
+// Returns {1, cooldown ms} when reserved, {0, wait ms} in cooldown, {-1, wait ms} over quota.
+var reserveOTPSendScript = redis.NewScript(`
+local n = #KEYS / 2
+local wait = 0
+for i = 1, n do
+	local ttl = redis.call('PTTL', KEYS[n + i])
+	if ttl > wait then wait = ttl end
+end
+if wait > 0 then return {0, wait} end
+
+local sends = 0
+for i = 1, n do
+	local count = tonumber(redis.call('GET', KEYS[i]) or '0')
+	if count >= tonumber(ARGV[2 + 2 * i]) then
+		local ttl = redis.call('PTTL', KEYS[i])
+		if ttl > wait then wait = ttl end
+	end
+	if ARGV[3 + 2 * i] == '1' and count > sends then sends = count end
+end
+if wait > 0 then return {-1, wait} end
+
+local cooldown = math.min(tonumber(ARGV[1]) * 2 ^ sends, tonumber(ARGV[2]))
+for i = 1, n do
+	if redis.call('INCR', KEYS[i]) == 1 then
+		redis.call('PEXPIRE', KEYS[i], ARGV[3])
+	end
+	redis.call('SET', KEYS[n + i], '1', 'PX', math.floor(cooldown))
+end
+return {1, math.floor(cooldown)}
+`)
+
+// ReserveOTPSend records an OTP send against every limit and returns the cooldown until the
+// next one, or an *OTPThrottledError when one of the limits does not allow a send yet
+func (s *RedisService) ReserveOTPSend(limits []OTPSendLimit, baseCooldown, maxCooldown, window time.Duration) (time.Duration, error) {
+	keys := make([]string, 0, 2*len(limits))
+	for _, limit := range limits {
+		keys = append(keys, fmt.Sprintf("otp_sends:%s", limit.Key))
+	}
+	for _, limit := range limits {
+		keys = append(keys, fmt.Sprintf("otp_cooldown:%s", limit.Key))
+	}
+	args := []interface{}{baseCooldown.Milliseconds(), maxCooldown.Milliseconds(), window.Milliseconds()}
+	for _, limit := range limits {
+		backoff := 0
+		if limit.Backoff {
+			backoff = 1
+		}
+		args = append(args, limit.DailyLimit, backoff)
+	}
+
+	result, err := reserveOTPSendScript.Run(ctx, s.rdb, keys, args...).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	if len(result) != 2 {
+		return 0, errors.New("unexpected OTP throttle result")
+	}
+	wait := time.Duration(result[1]) * time.Millisecond
+	switch result[0] {
+	case 1:
+		return wait, nil
+	case 0:
+		return 0, &OTPThrottledError{RetryAfter: wait, Reason: "please wait before requesting a new code"}
+	default:
+		return 0, &OTPThrottledError{RetryAfter: wait, Reason: "daily OTP limit reached"}
+	}
+}
+
+// RateLimitResult is the state of a rate limit key after a request was counted against it
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the oldest request in the window expires and frees a slot
+	Reset time.Duration
+}
+
+// slidingWindowScript keeps the timestamps of the requests inside the window in a sorted set.
+// KEYS: limit key. ARGV: now ms, window ms, limit, unique member.
+// Returns {allowed, requests in window, ms until the oldest request leaves the window}.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	count = count + 1
+	allowed = 1
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local reset = window
+if oldest[2] then reset = tonumber(oldest[2]) + window - now end
+return {allowed, count, reset}
+`)
+
+// HitRateLimit counts a request against key using a sliding window of the given size
+func (s *RedisService) HitRateLimit(key string, limit int, window time.Duration) (*RateLimitResult, error) {
+	member, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	result, err := slidingWindowScript.Run(ctx, s.rdb, []string{fmt.Sprintf("rate_limit:%s", key)},
+		time.Now().UnixMilli(), window.Milliseconds(), limit, member).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != 3 {
+		return nil, errors.New("unexpected rate limit result")
+	}
+	remaining := limit - int(result[1])
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &RateLimitResult{
+		Allowed:   result[0] == 1,
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Duration(result[2]) * time.Millisecond,
+	}, nil
+}
+
+func (s *RedisService) StoreMFATicket(ticket *MFATicket, ttl time.Duration) error {
+	data, _ := json.Marshal(ticket)
+	return s.rdb.Set(ctx, fmt.Sprintf("mfa_ticket:%s", ticket.TicketId), data, ttl).Err()
+}
+
+func (s *RedisService) GetMFATicket(ticketId string) (*MFATicket, error) {
+	val, err := s.rdb.Get(ctx, fmt.Sprintf("mfa_ticket:%s", ticketId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var ticket MFATicket
+	if err := json.Unmarshal([]byte(val), &ticket); err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
+
+// ConsumeMFATicket atomically reads and deletes the ticket so it is exchanged for tokens only once
+func (s *RedisService) ConsumeMFATicket(ticketId string) (*MFATicket, error) {
+	val, err := s.rdb.GetDel(ctx, fmt.Sprintf("mfa_ticket:%s", ticketId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var ticket MFATicket
+	if err := json.Unmarshal([]byte(val), &ticket); err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
+
+// StorePendingTOTPSecret keeps a re-enrolled secret until the user confirms it with a code
+func (s *RedisService) StorePendingTOTPSecret(userId uint, secret string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, fmt.Sprintf("totp_pending:%d", userId), secret, ttl).Err()
+}
+
+func (s *RedisService) GetPendingTOTPSecret(userId uint) (string, error) {
+	return s.rdb.Get(ctx, fmt.Sprintf("totp_pending:%d", userId)).Result()
+}
+
+func (s *RedisService) DeletePendingTOTPSecret(userId uint) error {
+	return s.rdb.Del(ctx, fmt.Sprintf("totp_pending:%d", userId)).Err()
+}
+
+// GetLockout returns how long the factor of the user stays locked, zero when it is not locked
+func (s *RedisService) GetLockout(userId uint, factor string) (time.Duration, error) {
+	ttl, err := s.rdb.PTTL(ctx, fmt.Sprintf("lockout:%s:%d", factor, userId)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (s *RedisService) IncrementFailedAttempts(userId uint, factor string, window time.Duration) (int64, error) {
+	key := fmt.Sprintf("failed_attempts:%s:%d", factor, userId)
+	pipe := s.rdb.TxPipeline()
+	failures := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return failures.Val(), nil
+}
+
+// IncrementLockouts counts the lockouts of the factor, the count decides how long the next lock lasts
+func (s *RedisService) IncrementLockouts(userId uint, factor string, memory time.Duration) (int64, error) {
+	key := fmt.Sprintf("lockouts:%s:%d", factor, userId)
+	pipe := s.rdb.TxPipeline()
+	lockouts := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, memory)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return lockouts.Val(), nil
+}
+
+// Lock locks the factor and resets its failure counter
+func (s *RedisService) Lock(userId uint, factor string, duration time.Duration) error {
+	pipe := s.rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("lockout:%s:%d", factor, userId), time.Now().Add(duration).Unix(), duration)
+	pipe.Del(ctx, fmt.Sprintf("failed_attempts:%s:%d", factor, userId))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisService) ClearFailedAttempts(userId uint, factor string) error {
+	return s.rdb.Del(ctx, fmt.Sprintf("failed_attempts:%s:%d", factor, userId)).Err()
+}
+
+// Unlock lifts the lock of the factor and forgets its failures and previous lockouts
+func (s *RedisService) Unlock(userId uint, factor string) error {
+	return s.rdb.Del(ctx,
+		fmt.Sprintf("lockout:%s:%d", factor, userId),
+		fmt.Sprintf("failed_attempts:%s:%d", factor, userId),
+		fmt.Sprintf("lockouts:%s:%d", factor, userId),
+	).Err()
+}
+
+func (s *RedisService) StorePasskeyTransaction(tx *PasskeyTransaction, ttl time.Duration) error {
+	data, _ := json.Marshal(tx)
+	return s.rdb.Set(ctx, fmt.Sprintf("passkey_tx:%s", tx.TransactionId), data, ttl).Err()
+}
+
+// ConsumePasskeyTransaction deletes the user's transaction and returns it so it is approved only once.
+// NOTE: The owner is checked before deleting, another user knowing the id must not be able to burn it. A stored
+// transaction never changes, so if GETDEL finds nothing a parallel finish has consumed it in between.
+func (s *RedisService) ConsumePasskeyTransaction(transactionId string, userId uint) (*PasskeyTransaction, error) {
+	key := fmt.Sprintf("passkey_tx:%s", transactionId)
+	val, err := s.rdb.Get(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	var tx PasskeyTransaction
+	if err := json.Unmarshal([]byte(val), &tx); err != nil {
+		return nil, err
+	}
+	if tx.UserId != userId {
+		return nil, ErrTransactionNotFound
+	}
+	if err := s.rdb.GetDel(ctx, key).Err(); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func (s *RedisService) StoreOAuthAttempt(attempt *OAuthAttempt, ttl time.Duration) error {
+	data, _ := json.Marshal(attempt)
+	return s.rdb.Set(ctx, fmt.Sprintf("oauth_state:%s", attempt.State), data, ttl).Err()
+}
+
+// ConsumeOAuthAttempt atomically reads and deletes the attempt so a state is accepted only once
+func (s *RedisService) ConsumeOAuthAttempt(state string) (*OAuthAttempt, error) {
+	val, err := s.rdb.GetDel(ctx, fmt.Sprintf("oauth_state:%s", state)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var attempt OAuthAttempt
+	if err := json.Unmarshal([]byte(val), &attempt); err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// AcquireLock takes a cluster wide lock, the returned token is needed to release it
+func (s *RedisService) AcquireLock(name string, ttl time.Duration) (string, bool, error) {
+	token, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", false, err
+	}
+	acquired, err := s.rdb.SetNX(ctx, fmt.Sprintf("lock:%s", name), token, ttl).Result()
+	if err != nil {
+		return "", false, err
+	}
+	return token, acquired, nil
+}
+
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// ReleaseLock frees the lock only if it is still held with token, an expired lock taken over by another
+// instance is left alone
+func (s *RedisService) ReleaseLock(name, token string) error {
+	return releaseLockScript.Run(ctx, s.rdb, []string{fmt.Sprintf("lock:%s", name)}, token).Err()
 }
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"time"
+	"user_management_ms/repository"
+	"user_management_ms/util"
+
+	"gorm.io/gorm"
+)
+
+const (
+	reencryptBatchSize = 100
+	// reencryptLockTTL bounds a run, a crashed instance releases the lock when it expires
+	reencryptLockTTL = 30 * time.Minute
+)
+
+// ErrReencryptionRunning is returned while another instance holds the re-encryption lock
+var ErrReencryptionRunning = errors.New("re-encryption is already running on another instance")
+
+// SecretReencryptor moves encrypted columns sealed with an older master key, or still stored as
+// plaintext, to the current master key after a rotation
+type SecretReencryptor struct {
+	db    *gorm.DB
+	repo  repository.IUserRepository
+	redis IRedisService
+}
+
+func NewSecretReencryptor(db *gorm.DB, repo repository.IUserRepository, redis IRedisService) *SecretReencryptor {
+	return &SecretReencryptor{db: db, repo: repo, redis: redis}
+}
+
+// Run re-encrypts every stale row and returns how many were updated. A Redis lock keeps the replicas
+// from scanning and rewriting the same rows at the same time.
+func (r *SecretReencryptor) Run() (int, error) {
+	version := util.CurrentKeyVersion()
+	if version == 0 {
+		return 0, nil
+	}
+	token, acquired, err := r.redis.AcquireLock("reencrypt_secrets", reencryptLockTTL)
+	if err != nil {
+		return 0, err
+	}
+	if !acquired {
+		return 0, ErrReencryptionRunning
+	}
+	defer func() {
+		if err := r.redis.ReleaseLock("reencrypt_secrets", token); err != nil {
+			log.Println("Failed to release re-encryption lock:", err)
+		}
+	}()
+	users, err := r.reencryptUsers(version)
+	if err != nil {
+		return users, err
+	}
+	passkeys, err := r.reencryptPasskeys(version)
+	return users + passkeys, err
+}
+
+// Start runs the job once in the background and then on every interval, a zero interval runs it once
+func (r *SecretReencryptor) Start(interval time.Duration) {
+	go func() {
+		r.runAndLog()
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			r.runAndLog()
+		}
+	}()
+}
+
+func (r *SecretReencryptor) runAndLog() {
+	count, err := r.Run()
+	if errors.Is(err, ErrReencryptionRunning) {
+		return
+	}
+	if err != nil {
+		log.Println("Failed to re-encrypt secrets:", err)
+	}
+	if count > 0 {
+		log.Printf("Re-encrypted %d rows with master key %d", count, util.CurrentKeyVersion())
+	}
+}
+
+func (r *SecretReencryptor) reencryptUsers(version int) (int, error) {
+	count := 0
+	var afterID uint
+	for {
+		users, err := r.repo.FindUsersWithStaleSecrets(r.db, version, afterID, reencryptBatchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(users) == 0 {
+			return count, nil
+		}
+		for i := range users {
+			updated, err := r.repo.ReencryptUserSecrets(r.db, &users[i], version)
+			if err != nil {
+				return count, err
+			}
+			if updated {
+				count++
+			}
+		}
+		afterID = users[len(users)-1].Id
+	}
+}
+
+func (r *SecretReencryptor) reencryptPasskeys(version int) (int, error) {
+	count := 0
+	var afterID uint
+	for {
+		passkeys, err := r.repo.FindPasskeysWithStaleKeys(r.db, version, afterID, reencryptBatchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(passkeys) == 0 {
+			return count, nil
+		}
+		for i := range passkeys {
+			updated, err := r.repo.ReencryptPasskey(r.db, &passkeys[i], version)
+			if err != nil {
+				return count, err
+			}
+			if updated {
+				count++
+			}
+		}
+		afterID = passkeys[len(passkeys)-1].ID
+	}
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+	"user_management_ms/domain"
+	"user_management_ms/dtos/request"
+	"user_management_ms/dtos/response"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hashicorp/go-uuid"
+)
+
+const (
+	LoginMethodPasswordOTP = "password_otp"
+	LoginMethodGoogle      = "google"
+	LoginMethodPasskey     = "passkey"
+	LoginMethodQR          = "qr"
+)
+
+// SessionOptions describes the login a new session is created for, AMR defaults to the
+// methods of the login method
+type SessionOptions struct {
+	LoginMethod string
+	Client      *request.ClientInfo
+	ApprovedBy  string
+	AMR         []string
+	// RequireMFA asks for a second factor even from users without TOTP, e.g. when a passkey assertion
+	// looks suspicious. They get an OTP to their verified email and phone instead.
+	RequireMFA bool
+}
+
+// loginAMR returns the authentication methods the primary factor of a login method consists of
+func loginAMR(loginMethod string) []string {
+	switch loginMethod {
+	case LoginMethodPasswordOTP:
+		return []string{AMRPassword, AMROTP}
+	case LoginMethodGoogle:
+		return []string{AMRGoogle, AMROTP}
+	case LoginMethodPasskey:
+		return []string{AMRWebAuthn}
+	case LoginMethodQR:
+		return []string{AMRQR}
+	}
+	return nil
+}
+
+// mfaTicketTTL is how long a user has to submit the second factor after the primary factor
+const mfaTicketTTL = 5 * time.Minute
+
+// Second factors an MFA ticket waits for
+const (
+	MFAFactorTOTP = "totp"
+	MFAFactorOTP  = "otp"
+)
+
+var ErrNoSecondFactor = errors.New("no verified email or phone to send a login code to")
+
+type ITokenService interface {
+	StartLogin(user *domain.User, opts *SessionOptions) (*response.Tokens, error)
+	IssueTokens(user *domain.User, opts *SessionOptions) (*response.Tokens, error)
+	IssueStepUpToken(claims jwt.MapClaims, method string) (*response.StepUpToken, error)
+	RotateRefreshToken(refreshToken string, client *request.ClientInfo) (*response.Tokens, error)
+	ValidateAccessToken(tokenStr string) (jwt.MapClaims, error)
+	RevokeSession(claims jwt.MapClaims) error
+	RevokeAllSessions(userId uint) error
+	ListSessions(userId uint, currentSessionId string) ([]response.Session, error)
+	RevokeUserSession(userId uint, sessionId string) error
+}
+
+type TokenService struct {
+	jwt       IJWTService
+	redis     IRedisService
+	otp       IOTPService
+	stepUpTTL time.Duration
+}
+
+func NewTokenService(jwt IJWTService, redis IRedisService, otp IOTPService, stepUpTtl time.Duration) ITokenService {
+	return &TokenService{jwt: jwt, redis: redis, otp: otp, stepUpTTL: stepUpTtl}
+}
+
+// StartLogin is called once the primary factor of a login succeeded. Users with TOTP enabled get
+// an MFA ticket to exchange at the TOTP step. With RequireMFA users without TOTP get a ticket too and
+// an OTP sent to them, everyone else gets their tokens right away.
+func (t *TokenService) StartLogin(user *domain.User, opts *SessionOptions) (*response.Tokens, error) {
+	if !user.Is2FAVerified && !opts.RequireMFA {
+		return t.IssueTokens(user, opts)
+	}
+	ticketId, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	ticket := &MFATicket{
+		TicketId:    ticketId,
+		UserId:      user.Id,
+		LoginMethod: opts.LoginMethod,
+		Factor:      MFAFactorTOTP,
+		Client:      opts.Client,
+		ApprovedBy:  opts.ApprovedBy,
+		CreatedAt:   time.Now(),
+	}
+	tokens := &response.Tokens{MfaRequired: true, MfaTicket: ticketId, MfaFactor: MFAFactorTOTP}
+	if !user.Is2FAVerified {
+		destinations := map[string]string{}
+		if user.EmailVerified && user.Email != "" {
+			destinations[OTPChannelEmail] = user.Email
+		}
+		if user.PhoneVerified && user.Phone != "" {
+			destinations[OTPChannelPhone] = user.Phone
+		}
+		if len(destinations) == 0 {
+			return nil, ErrNoSecondFactor
+		}
+		challengeId, resendAfter, err := t.otp.SendChallenge(OTPPurposeLoginMFA, user.Id, destinations, opts.Client)
+		if err != nil {
+			return nil, err
+		}
+		ticket.Factor = MFAFactorOTP
+		ticket.ChallengeId = challengeId
+		tokens.MfaFactor = MFAFactorOTP
+		tokens.ChallengeId = challengeId
+		tokens.ResendAfter = resendAfter
+	}
+	if err := t.redis.StoreMFATicket(ticket, mfaTicketTTL); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// IssueTokens starts a new session (refresh token family) for a fresh login and returns its first token pair
+func (t *TokenService) IssueTokens(user *domain.User, opts *SessionOptions) (*response.Tokens, error) {
+	familyId, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	jti, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	amr := opts.AMR
+	if amr == nil {
+		amr = loginAMR(opts.LoginMethod)
+	}
+	now := time.Now()
+	tokens, err := t.jwt.GenerateTokens(user, familyId, jti, &AuthContext{AuthTime: now, AMR: amr, ACR: ACRLogin})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.redis.StoreRefreshToken(&RefreshTokenRecord{
+		Jti:      jti,
+		FamilyId: familyId,
+		UserId:   user.Id,
+		IssuedAt: now,
+	}); err != nil {
+		return nil, err
+	}
+	family := &RefreshTokenFamily{
+		FamilyId:    familyId,
+		UserId:      user.Id,
+		CurrentJti:  jti,
+		LoginMethod: opts.LoginMethod,
+		ApprovedBy:  opts.ApprovedBy,
+		AMR:         amr,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+	}
+	if opts.Client != nil {
+		family.DeviceName = opts.Client.DeviceName
+		family.UserAgent = opts.Client.UserAgent
+		family.IP = opts.Client.IP
+	}
+	if err := t.redis.SaveRefreshFamily(family); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RotateRefreshToken exchanges the latest refresh token of a family for a new pair.
+// Presenting a token that was already rotated revokes the whole family.
+func (t *TokenService) RotateRefreshToken(refreshToken string, client *request.ClientInfo) (*response.Tokens, error) {
+	token, err := t.jwt.ParseJWT(refreshToken)
+	if err != nil || token == nil {
+		return nil, errors.New("invalid refresh token")
+	}
+	claims, err := t.jwt.GetClaims(token)
+	if err != nil {
+		return nil, err
+	}
+	jti, _ := claims["jti"].(string)
+	familyId, _ := claims["fid"].(string)
+	if claims["token_use"] != TokenUseRefresh || jti == "" || familyId == "" {
+		return nil, errors.New("invalid refresh token")
+	}
+
+	record, err := t.redis.GetRefreshToken(jti)
+	if err != nil || record.FamilyId != familyId {
+		return nil, errors.New("refresh token not found or expired")
+	}
+	family, err := t.redis.GetRefreshFamily(familyId)
+	if err != nil {
+		return nil, errors.New("refresh token revoked or expired")
+	}
+
+	firstUse, err := t.redis.MarkRefreshTokenRotated(jti)
+	if err != nil {
+		return nil, err
+	}
+	if !firstUse || family.CurrentJti != jti {
+		t.handleReuse(family, jti)
+		return nil, errors.New("refresh token reuse detected, session revoked")
+	}
+
+	nextJti, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: A refresh does not re-authenticate the user, the session keeps its login time
+	tokens, err := t.jwt.GenerateTokens(&domain.User{Id: family.UserId}, familyId, nextJti, &AuthContext{
+		AuthTime: family.CreatedAt,
+		AMR:      family.AMR,
+		ACR:      ACRLogin,
+	})
+	if err != nil {
+		return nil, errors.New("failed to generate tokens")
+	}
+
+	now := time.Now()
+	if err := t.redis.StoreRefreshToken(&RefreshTokenRecord{
+		Jti:       nextJti,
+		FamilyId:  familyId,
+		ParentJti: jti,
+		UserId:    family.UserId,
+		IssuedAt:  now,
+	}); err != nil {
+		return nil, errors.New("could not store new refresh token")
+	}
+	family.CurrentJti = nextJti
+	family.LastUsedAt = now
+	if client != nil && client.IP != "" {
+		family.IP = client.IP
+	}
+	if err := t.redis.SaveRefreshFamily(family); err != nil {
+		return nil, errors.New("could not store new refresh token")
+	}
+	return tokens, nil
+}
+
+// IssueStepUpToken mints a short-lived elevated access token for the session of claims after the user
+// re-authenticated with method. There is no refresh token, once it expires the user steps up again.
+func (t *TokenService) IssueStepUpToken(claims jwt.MapClaims, method string) (*response.StepUpToken, error) {
+	userId, _ := claims["sub"].(float64)
+	familyId, _ := claims["fid"].(string)
+	if userId == 0 {
+		return nil, errors.New("invalid token")
+	}
+	token, err := t.jwt.GenerateToken(uint(userId), familyId, &AuthContext{
+		AuthTime: time.Now(),
+		AMR:      []string{method},
+		ACR:      ACRStepUp,
+	}, t.stepUpTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &response.StepUpToken{
+		AccessToken: token,
+		ExpiresIn:   int(t.stepUpTTL.Seconds()),
+		Acr:         strconv.Itoa(ACRStepUp),
+	}, nil
+}
+
+// ValidateAccessToken verifies the token signature and checks it against the revocation lists
+func (t *TokenService) ValidateAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	token, err := t.jwt.ParseJWT(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := t.jwt.GetClaims(token)
+	if err != nil || claims["token_use"] != TokenUseAccess {
+		return nil, errors.New("invalid token")
+	}
+	jti, _ := claims["jti"].(string)
+	familyId, _ := claims["fid"].(string)
+	userId, _ := claims["sub"].(float64)
+	issuedAtMs, _ := claims["iat_ms"].(float64)
+
+	revoked, err := t.redis.IsAccessTokenRevoked(jti, familyId, uint(userId), time.UnixMilli(int64(issuedAtMs)))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("token revoked")
+	}
+	return claims, nil
+}
+
+// RevokeSession logs out the session the access token belongs to
+func (t *TokenService) RevokeSession(claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	familyId, _ := claims["fid"].(string)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		if err := t.redis.DenyAccessToken(jti, time.Until(exp.Time)); err != nil {
+			return err
+		}
+	}
+	if familyId == "" {
+		return nil
+	}
+	return t.redis.RevokeRefreshFamily(familyId)
+}
+
+// RevokeAllSessions logs the user out on every device
+func (t *TokenService) RevokeAllSessions(userId uint) error {
+	families, err := t.redis.GetUserRefreshFamilies(userId)
+	if err != nil {
+		return err
+	}
+	for _, familyId := range families {
+		if err := t.redis.RevokeRefreshFamily(familyId); err != nil {
+			return err
+		}
+	}
+	return t.redis.RevokeUserTokensBefore(userId, time.Now())
+}
+
+// ListSessions returns the active sessions of the user, currentSessionId is flagged as the caller's own
+func (t *TokenService) ListSessions(userId uint, currentSessionId string) ([]response.Session, error) {
+	familyIds, err := t.redis.GetUserRefreshFamilies(userId)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]response.Session, 0, len(familyIds))
+	for _, familyId := range familyIds {
+		family, err := t.redis.GetRefreshFamily(familyId)
+		if err != nil {
+			// NOTE: Expired family, drop it from the user's index
+			_ = t.redis.RemoveUserRefreshFamily(userId, familyId)
+			continue
+		}
+		sessions = append(sessions, response.Session{
+			SessionId:   family.FamilyId,
+			DeviceName:  family.DeviceName,
+			UserAgent:   family.UserAgent,
+			IP:          family.IP,
+			LoginMethod: family.LoginMethod,
+			CreatedAt:   family.CreatedAt,
+			LastUsedAt:  family.LastUsedAt,
+			Current:     family.FamilyId == currentSessionId,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+// RevokeUserSession logs out one of the user's sessions
+func (t *TokenService) RevokeUserSession(userId uint, sessionId string) error {
+	family, err := t.redis.GetRefreshFamily(sessionId)
+	if err != nil || family.UserId != userId {
+		return errors.New("session not found")
+	}
+	return t.redis.RevokeRefreshFamily(sessionId)
+}
+
+func (t *TokenService) handleReuse(family *RefreshTokenFamily, jti string) {
+	log.Printf("Refresh token reuse detected for user %d, revoking family %s", family.UserId, family.FamilyId)
+	if err := t.redis.RevokeRefreshFamily(family.FamilyId); err != nil {
+		log.Println("Failed to revoke refresh token family:", err)
+	}
+	PublishSecurityEvent(&request.SecurityEvent{
+		Type:       "refresh_token_reuse",
+		UserId:     family.UserId,
+		Reason:     "an already rotated refresh token was presented",
+		Metadata:   map[string]string{"family_id": family.FamilyId, "jti": jti},
+		OccurredAt: time.Now(),
+	})
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+	"user_management_ms/config"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	defaultTOTPIssuer = "Mocrypt Security Issuer"
+	defaultTOTPPeriod = 30
+)
+
+// totpOpts returns the configured TOTP parameters, the defaults are compatible with Google Authenticator
+func totpOpts() totp.ValidateOpts {
+	conf := config.Conf.Application.Security.Totp
+	opts := totp.ValidateOpts{
+		Period:    uint(positiveOr(conf.PeriodInSeconds, defaultTOTPPeriod)),
+		Skew:      uint(max(conf.Skew, 0)),
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	if conf.Digits == 8 {
+		opts.Digits = otp.DigitsEight
+	}
+	switch strings.ToUpper(conf.Algorithm) {
+	case "SHA256":
+		opts.Algorithm = otp.AlgorithmSHA256
+	case "SHA512":
+		opts.Algorithm = otp.AlgorithmSHA512
+	}
+	return opts
+}
+
+func totpGenerateOpts(accountName string) totp.GenerateOpts {
+	opts := totpOpts()
+	issuer := config.Conf.Application.Security.Totp.Issuer
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
+	return totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: accountName,
+		Period:      opts.Period,
+		Digits:      opts.Digits,
+		Algorithm:   opts.Algorithm,
+	}
+}
+
+// matchTOTPStep returns the time-step the code was generated for when it matches within the allowed skew
+func matchTOTPStep(code, secret string, now time.Time) (int64, bool) {
+	opts := totpOpts()
+	period := int64(opts.Period)
+	current := now.Unix() / period
+	stepOpts := opts
+	stepOpts.Skew = 0
+
+	for offset := -int64(opts.Skew); offset <= int64(opts.Skew); offset++ {
+		step := current + offset
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0), stepOpts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
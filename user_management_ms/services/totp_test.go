@@ -0,0 +1,178 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"user_management_ms/config"
+	"user_management_ms/domain"
+	"user_management_ms/repository"
+
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// useTOTPConfig installs the TOTP settings for the test and restores the previous ones after it
+func useTOTPConfig(t *testing.T, conf config.Totp) {
+	t.Helper()
+	previous := config.Conf.Application.Security.Totp
+	config.Conf.Application.Security.Totp = conf
+	t.Cleanup(func() { config.Conf.Application.Security.Totp = previous })
+}
+
+// testTOTPCode generates the code of the given time-step with the configured parameters
+func testTOTPCode(t *testing.T, step int64) string {
+	t.Helper()
+	opts := totpOpts()
+	opts.Skew = 0
+	code, err := totp.GenerateCodeCustom(testTOTPSecret, time.Unix(step*int64(opts.Period), 0), opts)
+	if err != nil {
+		t.Fatalf("GenerateCodeCustom: %v", err)
+	}
+	return code
+}
+
+func TestMatchTOTPStepSkew(t *testing.T) {
+	// NOTE: Middle of a step, so the current step does not depend on where in the period the test runs
+	now := time.Unix(1_700_000_015, 0)
+
+	tests := []struct {
+		name       string
+		conf       config.Totp
+		codeOffset int64
+		wantMatch  bool
+	}{
+		{name: "current step without skew", conf: config.Totp{}, codeOffset: 0, wantMatch: true},
+		{name: "previous step without skew", conf: config.Totp{}, codeOffset: -1},
+		{name: "next step without skew", conf: config.Totp{}, codeOffset: 1},
+		{name: "previous step with skew 1", conf: config.Totp{Skew: 1}, codeOffset: -1, wantMatch: true},
+		{name: "next step with skew 1", conf: config.Totp{Skew: 1}, codeOffset: 1, wantMatch: true},
+		{name: "two steps back with skew 1", conf: config.Totp{Skew: 1}, codeOffset: -2},
+		{name: "two steps ahead with skew 1", conf: config.Totp{Skew: 1}, codeOffset: 2},
+		{name: "two steps back with skew 2", conf: config.Totp{Skew: 2}, codeOffset: -2, wantMatch: true},
+		{name: "negative skew is treated as none", conf: config.Totp{Skew: -1}, codeOffset: -1},
+		{name: "custom period", conf: config.Totp{PeriodInSeconds: 60, Skew: 1}, codeOffset: -1, wantMatch: true},
+		{name: "eight digits sha256", conf: config.Totp{Digits: 8, Algorithm: "sha256"}, codeOffset: 0, wantMatch: true},
+		{name: "sha512 with skew", conf: config.Totp{Algorithm: "SHA512", Skew: 1}, codeOffset: 1, wantMatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTOTPConfig(t, tt.conf)
+			current := now.Unix() / int64(totpOpts().Period)
+			code := testTOTPCode(t, current+tt.codeOffset)
+
+			step, ok := matchTOTPStep(code, testTOTPSecret, now)
+			if ok != tt.wantMatch {
+				t.Fatalf("matchTOTPStep() matched = %v, want %v", ok, tt.wantMatch)
+			}
+			if ok && step != current+tt.codeOffset {
+				t.Fatalf("matchTOTPStep() step = %d, want %d", step, current+tt.codeOffset)
+			}
+		})
+	}
+}
+
+func TestMatchTOTPStepRejectsInvalidCodes(t *testing.T) {
+	useTOTPConfig(t, config.Totp{Skew: 1})
+	now := time.Unix(1_700_000_015, 0)
+	valid := testTOTPCode(t, now.Unix()/defaultTOTPPeriod)
+
+	tests := []struct {
+		name   string
+		code   string
+		secret string
+	}{
+		{name: "empty code", code: "", secret: testTOTPSecret},
+		{name: "wrong code", code: "000000", secret: testTOTPSecret},
+		{name: "truncated code", code: valid[:5], secret: testTOTPSecret},
+		{name: "other secret", code: valid, secret: "GEZDGNBVGY3TQOJQ"},
+		{name: "invalid secret", code: valid, secret: "not base32!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := matchTOTPStep(tt.code, tt.secret, now); ok {
+				t.Fatalf("matchTOTPStep(%q) matched, want no match", tt.code)
+			}
+		})
+	}
+}
+
+// fakeTOTPStepRepo keeps the last used time-step like the totp_last_step column
+type fakeTOTPStepRepo struct {
+	repository.IUserRepository
+	lastStep *int64
+}
+
+func (r *fakeTOTPStepRepo) MarkTOTPStepUsed(db *gorm.DB, userID uint, step int64) (bool, error) {
+	if r.lastStep != nil && *r.lastStep >= step {
+		return false, nil
+	}
+	r.lastStep = &step
+	return true, nil
+}
+
+type fakeTOTPLockout struct {
+	ILockoutService
+	failures, successes int
+}
+
+func (l *fakeTOTPLockout) Check(userId uint, factor string) error { return nil }
+
+func (l *fakeTOTPLockout) RecordFailure(userId uint, factor string) error {
+	l.failures++
+	return nil
+}
+
+func (l *fakeTOTPLockout) RecordSuccess(userId uint, factor string) error {
+	l.successes++
+	return nil
+}
+
+func TestCheckTOTPSecretRejectsReplay(t *testing.T) {
+	// NOTE: checkTOTPSecret reads the clock, a skew of 1 keeps the current code valid if the step rolls over mid test
+	useTOTPConfig(t, config.Totp{Skew: 1})
+
+	tests := []struct {
+		name      string
+		offsets   []int64
+		wantValid []bool
+	}{
+		{name: "same code twice", offsets: []int64{0, 0}, wantValid: []bool{true, false}},
+		{name: "next code after the previous one", offsets: []int64{0, 1}, wantValid: []bool{true, true}},
+		{name: "older code after a newer one", offsets: []int64{0, -1}, wantValid: []bool{true, false}},
+		{name: "code ahead of the clock burns the current one", offsets: []int64{1, 0}, wantValid: []bool{true, false}},
+		{name: "code outside the skew does not burn the step", offsets: []int64{-3, 0}, wantValid: []bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeTOTPStepRepo{}
+			lockout := &fakeTOTPLockout{}
+			u := &UserService{repo: repo, lockout: lockout}
+			user := &domain.User{Id: 1}
+			current := time.Now().Unix() / defaultTOTPPeriod
+
+			wantFailures := 0
+			for i, offset := range tt.offsets {
+				err := u.checkTOTPSecret(user, testTOTPSecret, testTOTPCode(t, current+offset))
+				if tt.wantValid[i] {
+					if err != nil {
+						t.Fatalf("attempt %d: checkTOTPSecret() = %v, want nil", i, err)
+					}
+					if user.TOTPLastStep == nil || *user.TOTPLastStep != current+offset {
+						t.Fatalf("attempt %d: TOTPLastStep = %v, want %d", i, user.TOTPLastStep, current+offset)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrInvalidTOTP) {
+					t.Fatalf("attempt %d: checkTOTPSecret() = %v, want ErrInvalidTOTP", i, err)
+				}
+				wantFailures++
+			}
+			if lockout.failures != wantFailures {
+				t.Fatalf("recorded %d failures, want %d", lockout.failures, wantFailures)
+			}
+		})
+	}
+}
@@ -12,7 +12,8 @@ import (
 	"user_management_ms/repository"
 	"user_management_ms/util"
 
-	"github.com/hashicorp/go-uuid"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/skip2/go-qrcode"
 	"golang.org/x/crypto/bcrypt"
@@ -20,37 +21,70 @@ import (
 )
 
 type IUserService interface {
-	RegisterRequestOTP(request *request.StartRegistration) (*response.RegisterResponse, error)
+	RegisterRequestOTP(request *request.StartRegistration, client *request.ClientInfo) (*response.RegisterResponse, error)
 	VerifyRegisterOTP(otRequest *request.VerifyOTPRequest) (*response.OTPResponse, error)
-	CompleteRegistration(registerRequest *request.CompleteRegisterRequest) (*response.Tokens, error)
-	SendOTP(req *request.OTPRequest) (*response.SendOTPResponse, error)
-	VerifyLoginOTP(otRequest *request.VerifyOTPRequest) (*response.Tokens, error)
-	LoginLocal(req *request.LoginLocalRequest) (*response.LoginResponse, error)
-	RefreshToken(req *request.RefreshTokenReq) (*response.Tokens, error)
-	Setup2FA(email, phone string) (*response.TwoFASetupResponse, error)
-	Verify2FA(email, phone, code string) (bool, error)
-	SetPIN(email, phone, pin string) error
-	VerifyPIN(email, phone, pin string) (bool, error)
-	RequestLoginQr() ([]byte, string, error)
-	ApproveLoginQr(userId uint, sessionId string) error
-	CheckLoginQr(sessionId string) (*response.QrLoginResponse, error)
+	CompleteRegistration(registerRequest *request.CompleteRegisterRequest, client *request.ClientInfo) (*response.Tokens, error)
+	SendOTP(req *request.OTPRequest, client *request.ClientInfo) (*response.SendOTPResponse, error)
+	VerifyLoginOTP(otRequest *request.VerifyOTPRequest, client *request.ClientInfo) (*response.Tokens, error)
+	VerifyLoginMFA(req *request.MFAVerifyRequest, client *request.ClientInfo) (*response.Tokens, error)
+	VerifyLoginMFAOTP(req *request.MFAOTPRequest, client *request.ClientInfo) (*response.Tokens, error)
+	LoginLocal(req *request.LoginLocalRequest, client *request.ClientInfo) (*response.LoginResponse, error)
+	RefreshToken(req *request.RefreshTokenReq, client *request.ClientInfo) (*response.Tokens, error)
+	Logout(claims jwt.MapClaims) error
+	LogoutAll(userId uint) error
+	Setup2FA(userId uint) (*response.TwoFASetupResponse, error)
+	Verify2FA(userId uint, code string) ([]string, error)
+	VerifyLoginRecovery(req *request.MFARecoveryRequest, client *request.ClientInfo) (*response.Tokens, error)
+	RegenerateRecoveryCodes(userId uint, factor *request.SecondFactorRequest) ([]string, error)
+	Disable2FA(userId uint, factor *request.SecondFactorRequest) error
+	Reenroll2FA(userId uint, factor *request.SecondFactorRequest) (*response.TwoFASetupResponse, error)
+	ConfirmReenroll2FA(userId uint, code string) ([]string, error)
+	SetPIN(userId uint, pin string) error
+	VerifyPIN(userId uint, pin string) (bool, error)
+	ChangePIN(userId uint, req *request.ChangePINRequest) error
+	RequestPINReset(userId uint, client *request.ClientInfo) (*response.SendOTPResponse, error)
+	ResetPIN(userId uint, req *request.PINResetRequest) error
+	StepUp(claims jwt.MapClaims, req *request.StepUpRequest) (*response.StepUpToken, error)
+	RequestLoginQr(req *request.QrLoginRequest, client *request.ClientInfo) (*response.QrLoginChallenge, error)
+	ScanLoginQr(userId uint, scannerSessionId, sessionId string) (*response.QrLoginScan, error)
+	ApproveLoginQr(userId uint, approverSessionId, sessionId string) error
+	RejectLoginQr(userId uint, scannerSessionId, sessionId string) error
+	CancelLoginQr(sessionId, secret string) error
+	AuthorizeLoginQr(sessionId, secret string) error
+	CheckLoginQr(sessionId, secret string) (*response.QrLoginResponse, error)
+	WatchLoginQr(sessionId, secret string, emit func(*response.QrLoginResponse) error) error
 }
 
+var (
+	ErrInvalidTOTP         = errors.New("invalid 2FA code")
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+	ErrPINAlreadySet       = errors.New("PIN already set, change it with the current PIN or reset it")
+)
+
+const defaultPINLength = 6
+
+const (
+	recoveryCodeCount = 10
+	// pendingTOTPTTL is how long a re-enrolled secret waits for its confirmation code
+	pendingTOTPTTL = 10 * time.Minute
+)
+
 type UserService struct {
-	db    *gorm.DB
-	redis IRedisService
-	repo  repository.IUserRepository
-	jwt   IJWTService
+	db      *gorm.DB
+	redis   IRedisService
+	repo    repository.IUserRepository
+	jwt     IJWTService
+	tokens  ITokenService
+	otp     IOTPService
+	lockout ILockoutService
 }
 
-func NewUserService(db *gorm.DB, repo repository.IUserRepository, redis IRedisService, jwt IJWTService) IUserService {
-	return &UserService{db: db, repo: repo, redis: redis, jwt: jwt}
+func NewUserService(db *gorm.DB, repo repository.IUserRepository, redis IRedisService, jwt IJWTService, tokens ITokenService, otp IOTPService, lockout ILockoutService) IUserService {
+	return &UserService{db: db, repo: repo, redis: redis, jwt: jwt, tokens: tokens, otp: otp, lockout: lockout}
 }
 
-func (u *UserService) RegisterRequestOTP(req *request.StartRegistration) (*response.RegisterResponse, error) {
+func (u *UserService) RegisterRequestOTP(req *request.StartRegistration, client *request.ClientInfo) (*response.RegisterResponse, error) {
 	user, err := u.repo.GetUserWithEmailAndPhoneNumber(u.db, req.Email, req.Phone)
-	emailOtp := util.GenerateOTP()
-	phoneOtp := util.GenerateOTP()
 	if err == nil {
 		// User mövcuddur
 		if user.EmailVerified && user.PhoneVerified && user.Password == "" {
@@ -77,13 +111,8 @@ func (u *UserService) RegisterRequestOTP(req *request.StartRegistration) (*respo
 			}, nil
 		} else if !(user.EmailVerified && user.PhoneVerified) {
 			// User mövcuddur amma OTP verified deyil → OTP göndərilməlidir
-			if err := u.repo.SetUserEmailPhoneOtpAndExpireDates(u.db, user, emailOtp, phoneOtp); err != nil {
-				return nil, err
-			}
-			if err := SendVerifyEmailAndPhoneNumberEvent(
-				&request.VerifyEmailEvent{Email: user.Email, EmailOTP: emailOtp},
-				&request.VerifyPhoneEvent{Phone: user.Phone, PhoneOTP: phoneOtp},
-			); err != nil {
+			challengeId, resendAfter, err := u.sendEmailAndPhoneOTP(user, OTPPurposeRegister, client)
+			if err != nil {
 				return nil, err
 			}
 			return &response.RegisterResponse{
@@ -94,6 +123,8 @@ func (u *UserService) RegisterRequestOTP(req *request.StartRegistration) (*respo
 				PhoneVerified: user.PhoneVerified,
 				Completed:     false,
 				Status:        "verification_pending",
+				ChallengeId:   challengeId,
+				ResendAfter:   resendAfter,
 			}, nil
 		}
 	} else {
@@ -115,13 +146,8 @@ func (u *UserService) RegisterRequestOTP(req *request.StartRegistration) (*respo
 		if _, err := u.repo.Create(u.db, newUser); err != nil {
 			return nil, err
 		}
-		if err := u.repo.SetUserEmailPhoneOtpAndExpireDates(u.db, newUser, emailOtp, phoneOtp); err != nil {
-			return nil, err
-		}
-		if err := SendVerifyEmailAndPhoneNumberEvent(
-			&request.VerifyEmailEvent{Email: newUser.Email},
-			&request.VerifyPhoneEvent{Phone: newUser.Phone},
-		); err != nil {
+		challengeId, resendAfter, err := u.sendEmailAndPhoneOTP(newUser, OTPPurposeRegister, client)
+		if err != nil {
 			return nil, err
 		}
 
@@ -133,6 +159,8 @@ func (u *UserService) RegisterRequestOTP(req *request.StartRegistration) (*respo
 			EmailVerified: false,
 			PhoneVerified: false,
 			Completed:     false,
+			ChallengeId:   challengeId,
+			ResendAfter:   resendAfter,
 		}, nil
 	}
 
@@ -146,17 +174,13 @@ func (u *UserService) VerifyRegisterOTP(otRequest *request.VerifyOTPRequest) (*r
 		return nil, errors.New("user not found")
 	}
 
-	if time.Now().After(*user.EmailOtpExpireDate) || user.EmailOtp != otRequest.EmailOTP {
-		return nil, errors.New("email OTP invalid or expired")
-	}
-
-	if time.Now().After(*user.PhoneOtpExpireDate) || user.PhoneOtp != otRequest.PhoneOTP {
-		return nil, errors.New("phone OTP invalid or expired")
+	if err := u.verifyEmailAndPhoneOTP(user, OTPPurposeRegister, otRequest); err != nil {
+		return nil, err
 	}
 
 	user.PhoneVerified = true
 	user.EmailVerified = true
-	if err := u.repo.DeteUserOtpAndExpireDate(u.db, user); err != nil {
+	if err := u.repo.Update(u.db, user); err != nil {
 		return nil, err
 	}
 
@@ -169,7 +193,7 @@ func (u *UserService) VerifyRegisterOTP(otRequest *request.VerifyOTPRequest) (*r
 	}, nil
 }
 
-func (u *UserService) CompleteRegistration(req *request.CompleteRegisterRequest) (*response.Tokens, error) {
+func (u *UserService) CompleteRegistration(req *request.CompleteRegisterRequest, client *request.ClientInfo) (*response.Tokens, error) {
 	// 1. Check if user exists
 	user, err := u.repo.GetUserByEmail(u.db, req.Email)
 	if err != nil {
@@ -202,7 +226,7 @@ func (u *UserService) CompleteRegistration(req *request.CompleteRegisterRequest)
 	}
 
 	// 5. Generate tokens
-	tokens, err := u.jwt.GenerateTokens(user)
+	tokens, err := u.tokens.IssueTokens(user, &SessionOptions{LoginMethod: LoginMethodPasswordOTP, Client: client})
 	if err != nil {
 		return nil, err
 	}
@@ -213,286 +237,605 @@ func (u *UserService) CompleteRegistration(req *request.CompleteRegisterRequest)
 	}, nil
 }
 
-func (u *UserService) SendOTP(req *request.OTPRequest) (*response.SendOTPResponse, error) {
-	if err := u.repo.SaveUserOTPs(u.db, req.Email, req.Phone, 5*time.Minute); err != nil {
+// SendOTP resends the codes of a pending registration or of a login that already passed the password check
+func (u *UserService) SendOTP(req *request.OTPRequest, client *request.ClientInfo) (*response.SendOTPResponse, error) {
+	user, err := u.repo.GetUserWithEmailAndPhoneNumber(u.db, req.Email, req.Phone)
+	if err != nil {
+		return nil, err
+	}
+
+	purpose := OTPPurposeRegister
+	if user.EmailVerified && user.PhoneVerified {
+		if user.Password == "" {
+			return nil, errors.New("user already verified")
+		}
+		if !u.redis.HasActiveOTPChallenge(OTPPurposeLogin, user.Id) {
+			return nil, errors.New("no pending login, sign in with your password first")
+		}
+		purpose = OTPPurposeLogin
+	}
+
+	challengeId, resendAfter, err := u.sendEmailAndPhoneOTP(user, purpose, client)
+	if err != nil {
 		return nil, err
 	}
 	return &response.SendOTPResponse{
-		Email:  req.Email,
-		Phone:  req.Phone,
-		Status: "otp_sent",
+		Email:       req.Email,
+		Phone:       req.Phone,
+		Status:      "otp_sent",
+		ChallengeId: challengeId,
+		ResendAfter: resendAfter,
 	}, nil
 }
 
-func (u *UserService) LoginLocal(req *request.LoginLocalRequest) (*response.LoginResponse, error) {
+func (u *UserService) LoginLocal(req *request.LoginLocalRequest, client *request.ClientInfo) (*response.LoginResponse, error) {
 	user, err := u.repo.GetUserWithEmailAndPhoneNumber(u.db, req.Email, req.Phone)
 	if err != nil {
 		return nil, err
 	}
+	// NOTE: The lock is checked before the password so a locked account gives no hint about it
+	if err := u.lockout.Check(user.Id, FactorPassword); err != nil {
+		return nil, err
+	}
 	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		if err := u.lockout.RecordFailure(user.Id, FactorPassword); err != nil {
+			return nil, err
+		}
 		return nil, errors.New("invalid password")
 	}
-
-	// OTP yenidən generate və Kafka event
-	emailOTP := util.GenerateOTP()
-	phoneOTP := util.GenerateOTP()
-	if err := u.repo.SetUserEmailPhoneOtpAndExpireDates(u.db, user, emailOTP, phoneOTP); err != nil {
-		return nil, err
-	}
-	if err := SendVerifyEmailEventToKafka(&request.VerifyEmailEvent{
-		Email:    user.Email,
-		EmailOTP: emailOTP,
-	}); err != nil {
-		log.Println("Failed to send email event:", err)
+	if err := u.lockout.RecordSuccess(user.Id, FactorPassword); err != nil {
+		log.Println("Failed to reset password failures:", err)
 	}
 
-	if err := SendVerifyPhoneNumberEventToKafka(&request.VerifyPhoneEvent{
-		Phone:    user.Phone,
-		PhoneOTP: phoneOTP,
-	}); err != nil {
-		log.Println("Failed to send phone event:", err)
+	// OTP challenge yaradılır və Kafka event
+	challengeId, resendAfter, err := u.sendEmailAndPhoneOTP(user, OTPPurposeLogin, client)
+	if err != nil {
+		return nil, err
 	}
 
 	return &response.LoginResponse{
-		Email: user.Email,
-		Phone: user.Phone,
+		Email:       user.Email,
+		Phone:       user.Phone,
+		ChallengeId: challengeId,
+		ResendAfter: resendAfter,
 	}, nil
 }
 
-func (u *UserService) VerifyLoginOTP(otRequest *request.VerifyOTPRequest) (*response.Tokens, error) {
+func (u *UserService) VerifyLoginOTP(otRequest *request.VerifyOTPRequest, client *request.ClientInfo) (*response.Tokens, error) {
 	user, err := u.repo.GetUserWithEmailAndPhoneNumber(u.db, otRequest.Email, otRequest.Phone)
 	if err != nil || user == nil {
 		return nil, errors.New("user not found")
 	}
 
-	if user.EmailOtpExpireDate != nil && user.PhoneOtpExpireDate != nil {
-		if time.Now().After(*user.EmailOtpExpireDate) || user.EmailOtp != otRequest.EmailOTP {
-			return nil, errors.New("email OTP invalid or expired")
-		}
+	if !(user.EmailVerified && user.PhoneVerified) {
+		return nil, errors.New("user needs to be verified")
+	}
+	if err := u.verifyEmailAndPhoneOTP(user, OTPPurposeLogin, otRequest); err != nil {
+		return nil, err
+	}
 
-		if time.Now().After(*user.PhoneOtpExpireDate) || user.PhoneOtp != otRequest.PhoneOTP {
-			return nil, errors.New("phone OTP invalid or expired")
-		}
-	} else if user.EmailOtpExpireDate == nil && user.PhoneOtpExpireDate == nil {
-		if user.EmailVerified && user.PhoneVerified {
-			return nil, errors.New("user already verified")
-		} else {
-			return nil, errors.New("user needs to be verified")
-		}
+	// OTP-lər doğru → token yarat (və ya 2FA aktivdirsə MFA ticket), refresh token family Redis-ə yazılır
+	return u.tokens.StartLogin(user, &SessionOptions{LoginMethod: LoginMethodPasswordOTP, Client: client})
+}
 
+// VerifyLoginMFA completes a login that is waiting for the TOTP code of the user
+func (u *UserService) VerifyLoginMFA(req *request.MFAVerifyRequest, client *request.ClientInfo) (*response.Tokens, error) {
+	ticket, err := u.redis.GetMFATicket(req.MfaTicket)
+	if err != nil || ticket.Factor == MFAFactorOTP {
+		return nil, errors.New("MFA ticket invalid or expired")
 	}
-
-	if err := u.repo.DeteUserOtpAndExpireDate(u.db, user); err != nil {
+	user, err := u.repo.GetByID(u.db, ticket.UserId)
+	if err != nil {
 		return nil, err
 	}
+	if err := u.checkTOTP(user, req.Code); err != nil {
+		return nil, err
+	}
+	if _, err := u.redis.ConsumeMFATicket(req.MfaTicket); err != nil {
+		return nil, errors.New("MFA ticket invalid or expired")
+	}
+
+	opts := &SessionOptions{
+		LoginMethod: ticket.LoginMethod,
+		Client:      ticket.Client,
+		ApprovedBy:  ticket.ApprovedBy,
+		AMR:         append(loginAMR(ticket.LoginMethod), AMRTOTP),
+	}
+	if opts.Client == nil {
+		opts.Client = client
+	}
+	return u.tokens.IssueTokens(user, opts)
+}
 
-	// OTP-lər doğru → token yarat
-	tokens, err := u.jwt.GenerateTokens(user)
+// VerifyLoginMFAOTP completes a login that is waiting for the OTP sent to a user without TOTP
+func (u *UserService) VerifyLoginMFAOTP(req *request.MFAOTPRequest, client *request.ClientInfo) (*response.Tokens, error) {
+	ticket, err := u.redis.GetMFATicket(req.MfaTicket)
+	if err != nil || ticket.Factor != MFAFactorOTP {
+		return nil, errors.New("MFA ticket invalid or expired")
+	}
+	codes := map[string]string{}
+	if req.EmailOTP != "" {
+		codes[OTPChannelEmail] = req.EmailOTP
+	}
+	if req.PhoneOTP != "" {
+		codes[OTPChannelPhone] = req.PhoneOTP
+	}
+	challenge, err := u.otp.VerifyChallenge(ticket.ChallengeId, OTPPurposeLoginMFA, codes)
 	if err != nil {
 		return nil, err
 	}
+	if challenge.UserId != ticket.UserId {
+		return nil, ErrOTPInvalid
+	}
+	user, err := u.repo.GetByID(u.db, ticket.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := u.redis.ConsumeMFATicket(req.MfaTicket); err != nil {
+		return nil, errors.New("MFA ticket invalid or expired")
+	}
 
-	// Refresh token Redis-ə set edilir
-	if err := u.redis.SetRefreshToken(user.Id, tokens.RefreshToken); err != nil {
-		log.Println("Failed to store refresh token:", err)
+	opts := &SessionOptions{
+		LoginMethod: ticket.LoginMethod,
+		Client:      ticket.Client,
+		ApprovedBy:  ticket.ApprovedBy,
+		AMR:         append(loginAMR(ticket.LoginMethod), AMROTP),
+	}
+	if opts.Client == nil {
+		opts.Client = client
 	}
+	return u.tokens.IssueTokens(user, opts)
+}
 
-	return &response.Tokens{
-		AccessToken:  tokens.AccessToken,
-		RefreshToken: tokens.RefreshToken,
-	}, nil
+// sendEmailAndPhoneOTP creates a challenge for both channels of the user and delivers the codes.
+// It returns the challenge and the seconds until the client may ask for another send.
+func (u *UserService) sendEmailAndPhoneOTP(user *domain.User, purpose string, client *request.ClientInfo) (string, int, error) {
+	return u.otp.SendChallenge(purpose, user.Id, map[string]string{
+		OTPChannelEmail: user.Email,
+		OTPChannelPhone: user.Phone,
+	}, client)
+}
+
+func (u *UserService) verifyEmailAndPhoneOTP(user *domain.User, purpose string, otRequest *request.VerifyOTPRequest) error {
+	challenge, err := u.otp.VerifyChallenge(otRequest.ChallengeId, purpose, map[string]string{
+		OTPChannelEmail: otRequest.EmailOTP,
+		OTPChannelPhone: otRequest.PhoneOTP,
+	})
+	if err != nil {
+		return err
+	}
+	if challenge.UserId != user.Id {
+		return ErrOTPInvalid
+	}
+	return nil
 }
 
-func (u *UserService) RefreshToken(req *request.RefreshTokenReq) (*response.Tokens, error) {
+func (u *UserService) RefreshToken(req *request.RefreshTokenReq, client *request.ClientInfo) (*response.Tokens, error) {
 	log.Println("Someone tries to refresh access token")
 	if req.RefreshToken == "" {
 		return nil, errors.New("empty refresh token")
 	}
 
-	token, err := u.jwt.ParseJWT(req.RefreshToken)
-	if err != nil || token == nil {
+	tokens, err := u.tokens.RotateRefreshToken(req.RefreshToken, client)
+	if err != nil {
 		return nil, err
 	}
 
-	claims, err := u.jwt.GetClaims(token)
+	log.Println("Successfully sent a new refresh token")
+	return tokens, nil
+}
+
+func (u *UserService) Logout(claims jwt.MapClaims) error {
+	return u.tokens.RevokeSession(claims)
+}
+
+func (u *UserService) LogoutAll(userId uint) error {
+	return u.tokens.RevokeAllSessions(userId)
+}
+
+func (u *UserService) Setup2FA(userId uint) (*response.TwoFASetupResponse, error) {
+	user, err := u.repo.GetByID(u.db, userId)
 	if err != nil {
 		return nil, err
 	}
-	userID := uint(claims["sub"].(float64))
+	if user.Is2FAVerified {
+		return nil, errors.New("user already has 2FA verified")
+	}
 
-	storedToken, err := u.redis.GetRefreshToken(userID)
+	key, setup, err := newTOTPSetup(user)
 	if err != nil {
-		log.Println("Redis token not found:", err)
-		return nil, errors.New("refresh token not found or expired")
+		return nil, err
 	}
 
-	if storedToken != req.RefreshToken {
-		log.Println("Provided:", req.RefreshToken, "Stored:", storedToken)
-		return nil, errors.New("refresh token does not equal to stored token")
+	user.Google2FASecret = util.EncryptedString(key.Secret())
+	if err := u.repo.Update(u.db, user); err != nil {
+		return nil, err
 	}
+	return setup, nil
+}
 
-	newAccessToken, err := u.jwt.GenerateToken(userID, time.Duration(config.Conf.Application.Security.TokenValidityInSeconds)*time.Second)
+// newTOTPSetup generates a TOTP secret for the user together with its provisioning QR code
+func newTOTPSetup(user *domain.User) (*otp.Key, *response.TwoFASetupResponse, error) {
+	key, err := totp.Generate(totpGenerateOpts(user.Email))
 	if err != nil {
-		return nil, errors.New("failed to generate access token")
+		return nil, nil, err
 	}
 
-	newRefreshToken, err := u.jwt.GenerateToken(userID, time.Duration(config.Conf.Application.Security.TokenValidityInSecondsForRememberMe)*time.Second)
+	png, err := qrcode.Encode(key.URL(), qrcode.Medium, 256)
 	if err != nil {
-		return nil, errors.New("failed to generate refresh token")
+		return nil, nil, err
 	}
 
-	u.redis.DelRefreshToken(userID)
+	return key, &response.TwoFASetupResponse{
+		Secret: key.Secret(),
+		QRCode: png,
+	}, nil
+}
 
-	if err := u.redis.SetRefreshToken(userID, newRefreshToken); err != nil {
-		log.Println("Failed to store new refresh token")
-		return nil, errors.New("could not store new refresh token")
+// Verify2FA checks a TOTP code of the user. The first successful code enables 2FA and
+// returns the recovery codes, they are shown to the user only this once.
+func (u *UserService) Verify2FA(userId uint, code string) ([]string, error) {
+	user, err := u.repo.GetByID(u.db, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.checkTOTP(user, code); err != nil {
+		return nil, err
+	}
+	if user.Is2FAVerified {
+		return nil, nil
 	}
 
-	log.Println("Successfully sent a new refresh token")
-	return &response.Tokens{
-		AccessToken:  newAccessToken,
-		RefreshToken: newRefreshToken,
-	}, nil
+	user.Is2FAVerified = true
+	if err := u.repo.Update(u.db, user); err != nil {
+		return nil, err
+	}
+	return u.issueRecoveryCodes(user.Id)
 }
 
-func (u *UserService) Setup2FA(email, phone string) (*response.TwoFASetupResponse, error) {
-	user, err := u.repo.GetCompletedUsersByEmailAndPhone(u.db, email, phone)
+// VerifyLoginRecovery completes a login waiting for TOTP with a recovery code instead
+func (u *UserService) VerifyLoginRecovery(req *request.MFARecoveryRequest, client *request.ClientInfo) (*response.Tokens, error) {
+	ticket, err := u.redis.GetMFATicket(req.MfaTicket)
+	if err != nil || ticket.Factor == MFAFactorOTP {
+		return nil, errors.New("MFA ticket invalid or expired")
+	}
+	user, err := u.repo.GetByID(u.db, ticket.UserId)
 	if err != nil {
 		return nil, err
 	}
-	if user.Is2FAVerified {
-		return nil, errors.New("user already has 2FA verified")
+	if err := u.useRecoveryCode(user, req.RecoveryCode); err != nil {
+		return nil, err
+	}
+	if _, err := u.redis.ConsumeMFATicket(req.MfaTicket); err != nil {
+		return nil, errors.New("MFA ticket invalid or expired")
 	}
 
-	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "Mocrypt Security Issuer",
-		AccountName: user.Email,
-	})
+	opts := &SessionOptions{
+		LoginMethod: ticket.LoginMethod,
+		Client:      ticket.Client,
+		ApprovedBy:  ticket.ApprovedBy,
+		AMR:         append(loginAMR(ticket.LoginMethod), AMRRecovery),
+	}
+	if opts.Client == nil {
+		opts.Client = client
+	}
+	return u.tokens.IssueTokens(user, opts)
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of the user after a fresh second factor
+func (u *UserService) RegenerateRecoveryCodes(userId uint, factor *request.SecondFactorRequest) ([]string, error) {
+	user, err := u.enabled2FAUser(userId)
 	if err != nil {
 		return nil, err
 	}
+	if err := u.verifySecondFactor(user, factor); err != nil {
+		return nil, err
+	}
+	return u.issueRecoveryCodes(user.Id)
+}
 
-	user.Google2FASecret = key.Secret()
+// Disable2FA turns TOTP off and drops the recovery codes after a fresh second factor
+func (u *UserService) Disable2FA(userId uint, factor *request.SecondFactorRequest) error {
+	user, err := u.enabled2FAUser(userId)
+	if err != nil {
+		return err
+	}
+	if err := u.verifySecondFactor(user, factor); err != nil {
+		return err
+	}
+
+	user.Is2FAVerified = false
+	user.Google2FASecret = ""
 	if err := u.repo.Update(u.db, user); err != nil {
+		return err
+	}
+	if err := u.repo.DeleteRecoveryCodes(u.db, user.Id); err != nil {
+		return err
+	}
+	_ = u.redis.DeletePendingTOTPSecret(user.Id)
+	return nil
+}
+
+// Reenroll2FA starts moving 2FA to a new authenticator. The current secret stays active
+// until the new one is confirmed with ConfirmReenroll2FA.
+func (u *UserService) Reenroll2FA(userId uint, factor *request.SecondFactorRequest) (*response.TwoFASetupResponse, error) {
+	user, err := u.enabled2FAUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.verifySecondFactor(user, factor); err != nil {
 		return nil, err
 	}
 
-	png, err := qrcode.Encode(key.URL(), qrcode.Medium, 256)
+	key, setup, err := newTOTPSetup(user)
 	if err != nil {
 		return nil, err
 	}
+	if err := u.redis.StorePendingTOTPSecret(user.Id, key.Secret(), pendingTOTPTTL); err != nil {
+		return nil, err
+	}
+	return setup, nil
+}
 
-	return &response.TwoFASetupResponse{
-		Secret: key.Secret(),
-		QRCode: png,
-	}, nil
+// ConfirmReenroll2FA activates the re-enrolled secret and issues new recovery codes
+func (u *UserService) ConfirmReenroll2FA(userId uint, code string) ([]string, error) {
+	user, err := u.enabled2FAUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := u.redis.GetPendingTOTPSecret(user.Id)
+	if err != nil {
+		return nil, errors.New("no pending 2FA re-enrollment")
+	}
+	if err := u.checkTOTPSecret(user, secret, code); err != nil {
+		return nil, err
+	}
+
+	user.Google2FASecret = util.EncryptedString(secret)
+	if err := u.repo.Update(u.db, user); err != nil {
+		return nil, err
+	}
+	_ = u.redis.DeletePendingTOTPSecret(user.Id)
+	return u.issueRecoveryCodes(user.Id)
 }
 
-func (u *UserService) Verify2FA(email, phone, code string) (bool, error) {
-	user, err := u.repo.GetCompletedUsersByEmailAndPhone(u.db, email, phone)
+func (u *UserService) enabled2FAUser(userId uint) (*domain.User, error) {
+	user, err := u.repo.GetByID(u.db, userId)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	valid := totp.Validate(code, user.Google2FASecret)
-	if valid {
-		user.Is2FAVerified = true
-		err := u.repo.Update(u.db, user)
+	if !user.Is2FAVerified {
+		return nil, errors.New("2FA is not enabled")
+	}
+	return user, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code
+func (u *UserService) verifySecondFactor(user *domain.User, factor *request.SecondFactorRequest) error {
+	switch {
+	case factor.Code != "":
+		return u.checkTOTP(user, factor.Code)
+	case factor.RecoveryCode != "":
+		return u.useRecoveryCode(user, factor.RecoveryCode)
+	default:
+		return errors.New("a 2FA code or recovery code is required")
+	}
+}
+
+// useRecoveryCode burns one recovery code of the user, failures count towards the TOTP lockout
+func (u *UserService) useRecoveryCode(user *domain.User, code string) error {
+	if err := u.lockout.Check(user.Id, FactorTOTP); err != nil {
+		return err
+	}
+	used, err := u.repo.UseRecoveryCode(u.db, user.Id, util.HashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		if err := u.lockout.RecordFailure(user.Id, FactorTOTP); err != nil {
+			return err
+		}
+		return ErrInvalidRecoveryCode
+	}
+	if err := u.lockout.RecordSuccess(user.Id, FactorTOTP); err != nil {
+		log.Println("Failed to reset 2FA failures:", err)
+	}
+	return nil
+}
+
+// issueRecoveryCodes replaces the recovery codes of the user and returns the new plain codes
+func (u *UserService) issueRecoveryCodes(userId uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := util.GenerateRecoveryCode()
 		if err != nil {
-			log.Println("Failed to update user:", err)
+			return nil, err
 		}
+		codes[i] = code
+		hashes[i] = util.HashRecoveryCode(code)
+	}
+	if err := u.repo.ReplaceRecoveryCodes(u.db, userId, hashes); err != nil {
+		return nil, err
 	}
-	return valid, nil
+	return codes, nil
 }
 
-func (u *UserService) SetPIN(email, phone, pin string) error {
-	user, err := u.repo.GetCompletedUsersByEmailAndPhone(u.db, email, phone)
-	if err != nil {
+// checkTOTP validates a TOTP code of the user, failures count towards the TOTP lockout
+func (u *UserService) checkTOTP(user *domain.User, code string) error {
+	if user.Google2FASecret == "" {
+		return errors.New("2FA is not set up")
+	}
+	return u.checkTOTPSecret(user, string(user.Google2FASecret), code)
+}
+
+// checkTOTPSecret validates code against secret and rejects codes of an already used time-step
+func (u *UserService) checkTOTPSecret(user *domain.User, secret, code string) error {
+	if err := u.lockout.Check(user.Id, FactorTOTP); err != nil {
 		return err
 	}
+	step, valid := matchTOTPStep(code, secret, time.Now())
+	if valid {
+		fresh, err := u.repo.MarkTOTPStepUsed(u.db, user.Id, step)
+		if err != nil {
+			return err
+		}
+		valid = fresh
+		if fresh {
+			// NOTE: Keep the loaded user in sync so a later Save does not roll the step back
+			user.TOTPLastStep = &step
+		}
+	}
+	if !valid {
+		if err := u.lockout.RecordFailure(user.Id, FactorTOTP); err != nil {
+			return err
+		}
+		return ErrInvalidTOTP
+	}
+	if err := u.lockout.RecordSuccess(user.Id, FactorTOTP); err != nil {
+		log.Println("Failed to reset 2FA failures:", err)
+	}
+	return nil
+}
 
-	hashed, err := util.HashPIN(pin)
+// SetPIN sets the first PIN of the user, an existing PIN is only replaced by ChangePIN or ResetPIN
+func (u *UserService) SetPIN(userId uint, pin string) error {
+	user, err := u.repo.GetByID(u.db, userId)
 	if err != nil {
 		return err
 	}
-
-	user.PINHash = hashed
-	return u.repo.Update(u.db, user)
+	if user.PINHash != "" {
+		return ErrPINAlreadySet
+	}
+	return u.storePIN(user, pin)
 }
 
-func (u *UserService) VerifyPIN(email, phone, pin string) (bool, error) {
-	user, err := u.repo.GetCompletedUsersByEmailAndPhone(u.db, email, phone)
+func (u *UserService) VerifyPIN(userId uint, pin string) (bool, error) {
+	user, err := u.repo.GetByID(u.db, userId)
 	if err != nil {
 		return false, err
 	}
+	if err := u.checkPIN(user, pin); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	if user.PINHash == "" {
-		return false, errors.New("PIN not set")
+// ChangePIN replaces the PIN after checking the current one, wrong PINs count towards the PIN lockout
+func (u *UserService) ChangePIN(userId uint, req *request.ChangePINRequest) error {
+	user, err := u.repo.GetByID(u.db, userId)
+	if err != nil {
+		return err
 	}
-	valid := util.VerifyPIN(pin, user.PINHash)
-	if !valid {
-		return false, errors.New("invalid PIN")
+	if err := u.checkPIN(user, req.OldPIN); err != nil {
+		return err
 	}
-
-	return true, nil
+	if req.NewPIN == req.OldPIN {
+		return fmt.Errorf("%w: must differ from the current PIN", util.ErrPINPolicy)
+	}
+	return u.storePIN(user, req.NewPIN)
 }
 
-func (u *UserService) RequestLoginQr() ([]byte, string, error) {
-	sessionId, _ := uuid.GenerateUUID()
-	err := u.redis.StoreLoginSessionRedis(sessionId)
+// RequestPINReset sends codes to the email and phone of the user for a forgotten PIN
+func (u *UserService) RequestPINReset(userId uint, client *request.ClientInfo) (*response.SendOTPResponse, error) {
+	user, err := u.repo.GetByID(u.db, userId)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	url := fmt.Sprintf("https://mocadomain.com/qr-login?sessionId=%s", sessionId)
-	png, err := qrcode.Encode(url, qrcode.Medium, 256)
+	challengeId, resendAfter, err := u.sendEmailAndPhoneOTP(user, OTPPurposePINReset, client)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-
-	return png, sessionId, nil
+	return &response.SendOTPResponse{
+		Email:       user.Email,
+		Phone:       user.Phone,
+		Status:      "otp_sent",
+		ChallengeId: challengeId,
+		ResendAfter: resendAfter,
+	}, nil
 }
 
-func (u *UserService) ApproveLoginQr(userId uint, sessionId string) error {
-	session, err := u.redis.GetLoginSessionRedis(sessionId)
+// ResetPIN sets a new PIN once the codes of a pin_reset challenge are verified, this also lifts a PIN lockout
+func (u *UserService) ResetPIN(userId uint, req *request.PINResetRequest) error {
+	user, err := u.repo.GetByID(u.db, userId)
 	if err != nil {
-		return errors.New("session not found or redis problem")
+		return err
 	}
-	session.UserId = userId
-	session.Status = "APPROVED"
+	// NOTE: Checked before the codes so a rejected PIN does not burn the challenge
+	if err := util.CheckPINPolicy(req.NewPIN, pinLength(), user.BirthDate); err != nil {
+		return err
+	}
+	if err := u.verifyEmailAndPhoneOTP(user, OTPPurposePINReset, &request.VerifyOTPRequest{
+		ChallengeId: req.ChallengeId,
+		EmailOTP:    req.EmailOTP,
+		PhoneOTP:    req.PhoneOTP,
+	}); err != nil {
+		return err
+	}
+	if err := u.storePIN(user, req.NewPIN); err != nil {
+		return err
+	}
+	if err := u.lockout.Unlock(user.Id, FactorPIN); err != nil {
+		log.Println("Failed to lift PIN lockout:", err)
+	}
+	return nil
+}
 
-	if err := u.redis.UpdateLoginSessionRedis(sessionId, session); err != nil {
+// checkPIN verifies the PIN of the user, refusing while the PIN is locked and recording the outcome
+func (u *UserService) checkPIN(user *domain.User, pin string) error {
+	if user.PINHash == "" {
+		return errors.New("PIN not set")
+	}
+	if err := u.lockout.Check(user.Id, FactorPIN); err != nil {
 		return err
 	}
+	if !util.VerifyPIN(pin, user.PINHash) {
+		if err := u.lockout.RecordFailure(user.Id, FactorPIN); err != nil {
+			return err
+		}
+		return errors.New("invalid PIN")
+	}
+	if err := u.lockout.RecordSuccess(user.Id, FactorPIN); err != nil {
+		log.Println("Failed to reset PIN failures:", err)
+	}
 	return nil
 }
 
-func (u *UserService) CheckLoginQr(sessionId string) (*response.QrLoginResponse, error) {
-	session, err := u.redis.GetLoginSessionRedis(sessionId)
+func (u *UserService) storePIN(user *domain.User, pin string) error {
+	if err := util.CheckPINPolicy(pin, pinLength(), user.BirthDate); err != nil {
+		return err
+	}
+	hashed, err := util.HashPIN(pin)
 	if err != nil {
-		return &response.QrLoginResponse{Status: response.StatusExpired}, nil
+		return err
 	}
+	user.PINHash = hashed
+	return u.repo.Update(u.db, user)
+}
 
-	switch session.Status {
-	case "PENDING":
-		return &response.QrLoginResponse{Status: response.StatusPending}, nil
-	case "APPROVED":
-		user, err := u.repo.GetByID(u.db, session.UserId)
-		if err != nil {
+func pinLength() int {
+	return positiveOr(config.Conf.Application.Pin.Length, defaultPINLength)
+}
+
+// StepUp re-authenticates the user of a session with their PIN or a TOTP code and returns an elevated
+// token, the failures count towards the lockout of the factor like any other check
+func (u *UserService) StepUp(claims jwt.MapClaims, req *request.StepUpRequest) (*response.StepUpToken, error) {
+	userId, _ := claims["sub"].(float64)
+	switch req.Method {
+	case AMRPIN:
+		if _, err := u.VerifyPIN(uint(userId), req.PIN); err != nil {
 			return nil, err
 		}
-		tokens, err := u.jwt.GenerateTokens(user)
+	case AMRTOTP:
+		user, err := u.enabled2FAUser(uint(userId))
 		if err != nil {
 			return nil, err
 		}
-
-		// Once consumed, delete to avoid reuse
-		_ = u.redis.DeleteLoginSessionRedis(sessionId)
-
-		return &response.QrLoginResponse{
-			Status: response.StatusApproved,
-			Tokens: tokens,
-		}, nil
-
+		if err := u.checkTOTP(user, req.Code); err != nil {
+			return nil, err
+		}
 	default:
-		return &response.QrLoginResponse{Status: response.StatusExpired}, nil
+		return nil, errors.New("unsupported step-up method")
 	}
+	return u.tokens.IssueStepUpToken(claims, req.Method)
 }
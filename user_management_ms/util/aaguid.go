@@ -0,0 +1,40 @@
+package util
+
+import "github.com/hashicorp/go-uuid"
+
+// knownAuthenticators names common passkey providers by AAGUID, see the community passkey-authenticator-aaguids list
+var knownAuthenticators = map[string]string{
+	"ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4": "Google Password Manager",
+	"adce0002-35bc-c60a-648b-0b25f1f05503": "Chrome on Mac",
+	"fbfc3007-154e-4ecc-8c0b-6e020557d7bd": "iCloud Keychain",
+	"08987058-cadc-4b81-b6e1-30de50dcbe96": "Windows Hello",
+	"9ddd1817-af5a-4672-a2b9-3e3dd95000a9": "Windows Hello",
+	"6028b017-b1d4-4c02-b4b3-afcdafc96bb2": "Windows Hello",
+	"bada5566-a7aa-401f-bd96-45619a55120d": "1Password",
+	"d548826e-79b4-db40-a3d8-11116f7e8349": "Bitwarden",
+	"531126d6-e717-415c-9320-3d9aa6981239": "Dashlane",
+	"53414d53-554e-4700-0000-000000000000": "Samsung Pass",
+	"cb69481e-8ff7-4039-93ec-0a2729a154a8": "YubiKey 5 Series",
+	"fa2b99dc-9e39-4257-8f92-4a30d23c4118": "YubiKey 5 Series with NFC",
+}
+
+// FormatAAGUID renders the 16 byte AAGUID of an authenticator as a UUID, empty when it is not set
+func FormatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	formatted, err := uuid.FormatUUID(aaguid)
+	if err != nil {
+		return ""
+	}
+	return formatted
+}
+
+// AuthenticatorName returns a display name for the authenticator model, falling back to a generic name
+// for unknown models and authenticators that do not disclose their AAGUID (all zeros)
+func AuthenticatorName(aaguid []byte) string {
+	if name, ok := knownAuthenticators[FormatAAGUID(aaguid)]; ok {
+		return name
+	}
+	return "Passkey"
+}
@@ -0,0 +1,286 @@
+package util
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sealedPrefix marks an envelope encrypted value, the key version follows it: $env$<version>$<base64>
+const sealedPrefix = "$env$"
+
+const (
+	dataKeySize = 32
+	nonceSize   = 12
+	// wrappedKeySize is the data key sealed with AES-GCM, including its tag
+	wrappedKeySize = dataKeySize + 16
+)
+
+// Envelope encrypts values with a fresh AES-256-GCM data key per value and wraps that data key
+// with a versioned master key. Old master keys stay loaded so existing values remain readable.
+type Envelope struct {
+	current int
+	keys    map[int][]byte
+}
+
+var (
+	envelopeMu sync.RWMutex
+	envelope   *Envelope
+)
+
+// SetEnvelope installs the envelope used by EncryptedString and EncryptedBytes. Without one,
+// values are stored as plaintext.
+func SetEnvelope(e *Envelope) {
+	envelopeMu.Lock()
+	defer envelopeMu.Unlock()
+	envelope = e
+}
+
+func currentEnvelope() *Envelope {
+	envelopeMu.RLock()
+	defer envelopeMu.RUnlock()
+	return envelope
+}
+
+// CurrentKeyVersion returns the master key version new values are sealed with, zero while encryption is off
+func CurrentKeyVersion() int {
+	if e := currentEnvelope(); e != nil {
+		return e.current
+	}
+	return 0
+}
+
+func NewEnvelope(current int, keys map[int][]byte) (*Envelope, error) {
+	for version, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %d must be 32 bytes", version)
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("master key %d is not configured", current)
+	}
+	return &Envelope{current: current, keys: keys}, nil
+}
+
+// LoadEnvelope reads master keys given as "version:base64key" entries, from config and from a key file
+// with one entry per line. It returns nil when no key is configured.
+func LoadEnvelope(current int, entries []string, keyFile string) (*Envelope, error) {
+	if keyFile != "" {
+		file, err := os.Open(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[int][]byte, len(entries))
+	for _, entry := range entries {
+		versionPart, keyPart, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, errors.New("master key entries must look like version:base64key")
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(versionPart))
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid master key version %q", versionPart)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keyPart))
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %d: %w", version, err)
+		}
+		keys[version] = key
+	}
+	return NewEnvelope(current, keys)
+}
+
+// Seal encrypts plaintext with the current master key
+func (e *Envelope) Seal(plaintext []byte) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := gcmSeal(e.keys[e.current], dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := gcmSeal(dataKey, plaintext)
+	if err != nil {
+		return "", err
+	}
+	payload := append(wrapped, sealed...)
+	return fmt.Sprintf("%s%d$%s", sealedPrefix, e.current, base64.StdEncoding.EncodeToString(payload)), nil
+}
+
+// Open decrypts a value produced by Seal with whichever master key version sealed it
+func (e *Envelope) Open(value string) ([]byte, error) {
+	version, payload, err := parseSealed(value)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, ok := e.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("master key %d is not configured", version)
+	}
+	if len(payload) < nonceSize+wrappedKeySize {
+		return nil, errors.New("sealed value is too short")
+	}
+	dataKey, err := gcmOpen(masterKey, payload[:nonceSize+wrappedKeySize])
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dataKey, payload[nonceSize+wrappedKeySize:])
+}
+
+func parseSealed(value string) (int, []byte, error) {
+	rest, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return 0, nil, errors.New("value is not sealed")
+	}
+	versionPart, encoded, found := strings.Cut(rest, "$")
+	if !found {
+		return 0, nil, errors.New("malformed sealed value")
+	}
+	version, err := strconv.Atoi(versionPart)
+	if err != nil {
+		return 0, nil, errors.New("malformed sealed value")
+	}
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, nil, err
+	}
+	return version, payload, nil
+}
+
+// gcmSeal returns nonce || ciphertext || tag
+func gcmSeal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmOpen(key, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < nonceSize {
+		return nil, errors.New("sealed value is too short")
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a column value with the installed envelope, values pass through while encryption is off
+func seal(plaintext []byte) (string, error) {
+	e := currentEnvelope()
+	if e == nil || len(plaintext) == 0 {
+		return string(plaintext), nil
+	}
+	return e.Seal(plaintext)
+}
+
+// open decrypts a column value, plaintext written before encryption was enabled is returned as is
+func open(value string) ([]byte, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return []byte(value), nil
+	}
+	e := currentEnvelope()
+	if e == nil {
+		return nil, errors.New("encrypted value found but no master key is configured")
+	}
+	return e.Open(value)
+}
+
+func scanColumn(src interface{}) (string, error) {
+	switch v := src.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	default:
+		return "", fmt.Errorf("unsupported encrypted column type %T", src)
+	}
+}
+
+// EncryptedString is a string column stored envelope encrypted
+type EncryptedString string
+
+func (s *EncryptedString) Scan(src interface{}) error {
+	value, err := scanColumn(src)
+	if err != nil {
+		return err
+	}
+	plaintext, err := open(value)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	return seal([]byte(s))
+}
+
+// EncryptedBytes is a binary column stored envelope encrypted
+type EncryptedBytes []byte
+
+func (b *EncryptedBytes) Scan(src interface{}) error {
+	value, err := scanColumn(src)
+	if err != nil {
+		return err
+	}
+	plaintext, err := open(value)
+	if err != nil {
+		return err
+	}
+	*b = plaintext
+	return nil
+}
+
+func (b EncryptedBytes) Value() (driver.Value, error) {
+	if b == nil {
+		return nil, nil
+	}
+	sealed, err := seal(b)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sealed), nil
+}
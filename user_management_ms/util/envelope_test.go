@@ -0,0 +1,209 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testMasterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func mustEnvelope(t *testing.T, current int, keys map[int][]byte) *Envelope {
+	t.Helper()
+	e, err := NewEnvelope(current, keys)
+	if err != nil {
+		t.Fatalf("NewEnvelope: %v", err)
+	}
+	return e
+}
+
+func TestNewEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		current int
+		keys    map[int][]byte
+		wantErr bool
+	}{
+		{name: "single key", current: 1, keys: map[int][]byte{1: testMasterKey(1)}},
+		{name: "rotated keys", current: 2, keys: map[int][]byte{1: testMasterKey(1), 2: testMasterKey(2)}},
+		{name: "current key missing", current: 3, keys: map[int][]byte{1: testMasterKey(1)}, wantErr: true},
+		{name: "short key", current: 1, keys: map[int][]byte{1: make([]byte, 16)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEnvelope(tt.current, tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewEnvelope() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvelopeOpenAcrossKeyVersions(t *testing.T) {
+	v1 := mustEnvelope(t, 1, map[int][]byte{1: testMasterKey(1)})
+	v2 := mustEnvelope(t, 2, map[int][]byte{1: testMasterKey(1), 2: testMasterKey(2)})
+	v2Only := mustEnvelope(t, 2, map[int][]byte{2: testMasterKey(2)})
+
+	tests := []struct {
+		name        string
+		sealer      *Envelope
+		opener      *Envelope
+		wantVersion string
+		wantErr     bool
+	}{
+		{name: "same version", sealer: v1, opener: v1, wantVersion: "$env$1$"},
+		{name: "old version after rotation", sealer: v1, opener: v2, wantVersion: "$env$1$"},
+		{name: "current version after rotation", sealer: v2, opener: v2, wantVersion: "$env$2$"},
+		{name: "old version key removed", sealer: v1, opener: v2Only, wantVersion: "$env$1$", wantErr: true},
+		{name: "newer version unknown", sealer: v2, opener: v1, wantVersion: "$env$2$", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := []byte("JBSWY3DPEHPK3PXP")
+			sealed, err := tt.sealer.Seal(plaintext)
+			if err != nil {
+				t.Fatalf("Seal: %v", err)
+			}
+			if !strings.HasPrefix(sealed, tt.wantVersion) {
+				t.Fatalf("Seal() = %q, want prefix %q", sealed, tt.wantVersion)
+			}
+			if strings.Contains(sealed, string(plaintext)) {
+				t.Fatalf("Seal() leaks the plaintext: %q", sealed)
+			}
+
+			opened, err := tt.opener.Open(sealed)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Open() = %q, want error", opened)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Fatalf("Open() = %q, want %q", opened, plaintext)
+			}
+		})
+	}
+}
+
+func TestEnvelopeOpenRejectsBadValues(t *testing.T) {
+	e := mustEnvelope(t, 1, map[int][]byte{1: testMasterKey(1)})
+	sealed, err := e.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, "$env$1$"))
+	payload[len(payload)-1] ^= 0xff
+	tampered := "$env$1$" + base64.StdEncoding.EncodeToString(payload)
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "plaintext", value: "secret"},
+		{name: "missing version separator", value: "$env$1"},
+		{name: "non numeric version", value: "$env$x$AAAA"},
+		{name: "invalid base64", value: "$env$1$!!!"},
+		{name: "too short", value: "$env$1$" + base64.StdEncoding.EncodeToString([]byte("short"))},
+		{name: "tampered", value: tampered},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if opened, err := e.Open(tt.value); err == nil {
+				t.Fatalf("Open(%q) = %q, want error", tt.value, opened)
+			}
+		})
+	}
+}
+
+func TestEncryptedStringLegacyPlaintext(t *testing.T) {
+	e := mustEnvelope(t, 1, map[int][]byte{1: testMasterKey(1)})
+	sealed, err := e.Seal([]byte("sealed secret"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		envelope *Envelope
+		src      interface{}
+		want     string
+		wantErr  bool
+	}{
+		{name: "legacy plaintext string", envelope: e, src: "legacy secret", want: "legacy secret"},
+		{name: "legacy plaintext bytes", envelope: e, src: []byte("legacy secret"), want: "legacy secret"},
+		{name: "legacy plaintext without envelope", envelope: nil, src: "legacy secret", want: "legacy secret"},
+		{name: "null column", envelope: e, src: nil, want: ""},
+		{name: "sealed value", envelope: e, src: sealed, want: "sealed secret"},
+		{name: "sealed value as bytes", envelope: e, src: []byte(sealed), want: "sealed secret"},
+		{name: "sealed value without envelope", envelope: nil, src: sealed, wantErr: true},
+		{name: "unsupported type", envelope: e, src: 42, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetEnvelope(tt.envelope)
+			defer SetEnvelope(nil)
+			var s EncryptedString
+			err := s.Scan(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Scan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(s) != tt.want {
+				t.Fatalf("Scan() = %q, want %q", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptedValueRoundTrip(t *testing.T) {
+	e := mustEnvelope(t, 1, map[int][]byte{1: testMasterKey(1)})
+
+	tests := []struct {
+		name       string
+		envelope   *Envelope
+		value      string
+		wantSealed bool
+	}{
+		{name: "encryption on", envelope: e, value: "secret", wantSealed: true},
+		{name: "encryption off", envelope: nil, value: "secret"},
+		{name: "empty value stays empty", envelope: e, value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetEnvelope(tt.envelope)
+			defer SetEnvelope(nil)
+
+			stored, err := EncryptedString(tt.value).Value()
+			if err != nil {
+				t.Fatalf("EncryptedString.Value: %v", err)
+			}
+			if got := strings.HasPrefix(stored.(string), sealedPrefix); got != tt.wantSealed {
+				t.Fatalf("EncryptedString.Value() = %q, sealed %v, want %v", stored, got, tt.wantSealed)
+			}
+			var s EncryptedString
+			if err := s.Scan(stored); err != nil {
+				t.Fatalf("EncryptedString.Scan: %v", err)
+			}
+			if string(s) != tt.value {
+				t.Fatalf("EncryptedString round trip = %q, want %q", s, tt.value)
+			}
+
+			storedBytes, err := EncryptedBytes(tt.value).Value()
+			if err != nil {
+				t.Fatalf("EncryptedBytes.Value: %v", err)
+			}
+			var b EncryptedBytes
+			if err := b.Scan(storedBytes); err != nil {
+				t.Fatalf("EncryptedBytes.Scan: %v", err)
+			}
+			if string(b) != tt.value {
+				t.Fatalf("EncryptedBytes round trip = %q, want %q", b, tt.value)
+			}
+		})
+	}
+}
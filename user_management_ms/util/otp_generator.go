@@ -1,11 +1,31 @@
 package util
 
 import (
-	"math/rand"
-	"strconv"
+	"crypto/rand"
+	"errors"
+	"math/big"
 )
 
-func GenerateOTP() string {
-	otp := rand.Intn(900000) + 100000 // 100000 ile 999999 arasında sayı üret
-	return strconv.Itoa(otp)          // Sayıyı string'e çevir
+const DigitsAlphabet = "0123456789"
+
+// GenerateOTP returns a code of the given length drawn uniformly from alphabet using crypto/rand
+func GenerateOTP(length int, alphabet string) (string, error) {
+	if length <= 0 {
+		return "", errors.New("OTP length must be positive")
+	}
+	if alphabet == "" {
+		alphabet = DigitsAlphabet
+	}
+	symbols := []rune(alphabet)
+	max := big.NewInt(int64(len(symbols)))
+
+	code := make([]rune, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = symbols[n.Int64()]
+	}
+	return string(code), nil
 }
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrPINPolicy = errors.New("PIN does not meet the policy")
+
+// birthDateLayouts are the ways a birth date is commonly typed as digits
+var birthDateLayouts = []string{"0201", "0102", "2006", "020106", "010206", "060102", "02012006", "01022006", "20060102"}
+
+// CheckPINPolicy rejects PINs that are not exactly length digits, are a sequence like 1234 or 9876,
+// repeat a block like 1111 or 1212, or contain the user's birth date or birth year.
+func CheckPINPolicy(pin string, length int, birthDate *time.Time) error {
+	if len(pin) != length {
+		return fmt.Errorf("%w: must be %d digits", ErrPINPolicy, length)
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("%w: must contain digits only", ErrPINPolicy)
+		}
+	}
+	if isDigitSequence(pin) {
+		return fmt.Errorf("%w: must not be a sequence", ErrPINPolicy)
+	}
+	if isRepeatedBlock(pin) {
+		return fmt.Errorf("%w: must not repeat digits", ErrPINPolicy)
+	}
+	if birthDate != nil {
+		for _, layout := range birthDateLayouts {
+			if strings.Contains(pin, birthDate.Format(layout)) {
+				return fmt.Errorf("%w: must not contain the birth date", ErrPINPolicy)
+			}
+		}
+	}
+	return nil
+}
+
+// isDigitSequence reports whether every digit is one more, or every digit one less, than the previous
+func isDigitSequence(pin string) bool {
+	ascending, descending := true, true
+	for i := 1; i < len(pin); i++ {
+		step := int(pin[i]) - int(pin[i-1])
+		ascending = ascending && step == 1
+		descending = descending && step == -1
+	}
+	return ascending || descending
+}
+
+// isRepeatedBlock reports whether the PIN is a shorter block repeated, like 1111, 1212 or 123123
+func isRepeatedBlock(pin string) bool {
+	for size := 1; size <= len(pin)/2; size++ {
+		if len(pin)%size == 0 && strings.Repeat(pin[:size], len(pin)/size) == pin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckPINPolicy(t *testing.T) {
+	birthDate := time.Date(1990, time.July, 15, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		pin       string
+		length    int
+		birthDate *time.Time
+		wantErr   bool
+	}{
+		{name: "valid", pin: "4831", length: 4},
+		{name: "valid with birth date", pin: "4831", length: 4, birthDate: &birthDate},
+		{name: "valid six digits", pin: "482913", length: 6, birthDate: &birthDate},
+		{name: "too short", pin: "483", length: 4, wantErr: true},
+		{name: "too long", pin: "48310", length: 4, wantErr: true},
+		{name: "not digits", pin: "48a1", length: 4, wantErr: true},
+		{name: "ascending sequence", pin: "1234", length: 4, wantErr: true},
+		{name: "ascending sequence from zero", pin: "012345", length: 6, wantErr: true},
+		{name: "descending sequence", pin: "9876", length: 4, wantErr: true},
+		{name: "broken sequence", pin: "1235", length: 4},
+		{name: "same digit", pin: "1111", length: 4, wantErr: true},
+		{name: "repeated pair", pin: "1212", length: 4, wantErr: true},
+		{name: "repeated triple", pin: "493493", length: 6, wantErr: true},
+		{name: "almost repeated", pin: "1213", length: 4},
+		{name: "birth year", pin: "1990", length: 4, birthDate: &birthDate, wantErr: true},
+		{name: "birth year inside", pin: "219904", length: 6, birthDate: &birthDate, wantErr: true},
+		{name: "day and month", pin: "1507", length: 4, birthDate: &birthDate, wantErr: true},
+		{name: "month and day", pin: "0715", length: 4, birthDate: &birthDate, wantErr: true},
+		{name: "day month short year", pin: "150790", length: 6, birthDate: &birthDate, wantErr: true},
+		{name: "month day short year", pin: "071590", length: 6, birthDate: &birthDate, wantErr: true},
+		{name: "short year month day", pin: "900715", length: 6, birthDate: &birthDate, wantErr: true},
+		{name: "day month year", pin: "15071990", length: 8, birthDate: &birthDate, wantErr: true},
+		{name: "month day year", pin: "07151990", length: 8, birthDate: &birthDate, wantErr: true},
+		{name: "year month day", pin: "19900715", length: 8, birthDate: &birthDate, wantErr: true},
+		{name: "birth year without birth date", pin: "1990", length: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPINPolicy(tt.pin, tt.length, tt.birthDate)
+			if tt.wantErr {
+				if !errors.Is(err, ErrPINPolicy) {
+					t.Fatalf("CheckPINPolicy(%q) = %v, want ErrPINPolicy", tt.pin, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckPINPolicy(%q) = %v, want nil", tt.pin, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// recoveryCodeAlphabet leaves out 0/O and 1/I so codes survive being written down
+const recoveryCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GenerateRecoveryCode returns a random code formatted as XXXXX-XXXXX
+func GenerateRecoveryCode() (string, error) {
+	code, err := GenerateOTP(10, recoveryCodeAlphabet)
+	if err != nil {
+		return "", err
+	}
+	return code[:5] + "-" + code[5:], nil
+}
+
+// HashRecoveryCode hashes the code ignoring case, dashes and spaces. Codes carry 50 bits of
+// entropy and are single use, so a fast hash is enough and allows looking them up.
+func HashRecoveryCode(code string) string {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}